@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"path/filepath"
 	"saturn/mp"
 	"saturn/parser"
 	"saturn/shared"
-	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -25,9 +27,21 @@ type Assembler struct {
 	useTable        map[string][]uint16
 	locationCounter uint16
 	lineCounter     uint16
-	lstLineCounter  uint16
 	programName     string
-	errors          []string
+	programStart    int // address of the label named by START, -1 until it is defined
+	filePath        string
+	source          []string            // lines of the original source, for columns
+	includedSources map[string][]string // lines of files read by INCLUDE
+	currentLine     string
+	diagnostics     []shared.Diagnostic
+	origins         []mp.Origin             // where each line of the expanded source came from
+	listedLine      uint16                  // last expanded line in the listing
+	listedSource    uint16                  // last source line in the listing
+	valueSymbols    map[string]bool         // symbols defined by EQU (false) or SET (true)
+	usages          map[string]*symbolUsage // for the cross reference
+	debugLines      []debugLine
+	object          strings.Builder // the .obj file, written by the second pass
+	listing         strings.Builder // the .lst file, written by the second pass
 }
 
 func New() *Assembler {
@@ -35,51 +49,13 @@ func New() *Assembler {
 	assembler.symbolTable = map[string]shared.SymbolInfo{}
 	assembler.definitionTable = map[string]shared.SymbolInfo{}
 	assembler.useTable = map[string][]uint16{}
+	assembler.valueSymbols = map[string]bool{}
+	assembler.usages = map[string]*symbolUsage{}
+	assembler.includedSources = map[string][]string{}
+	assembler.programStart = -1
 	return assembler
 }
 
-// writes to file program.txt as its output
-func Run(filePaths ...string) (
-	definitionTables []map[string]shared.SymbolInfo, useTables []map[string][]uint16,
-	programNames []string, programSizes, stackSizes []uint16) {
-
-	isProgramStartSet := false
-	for _, filePath := range filePaths {
-		file, err := os.Open(filePath)
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-
-		assembler := New()
-		macroProcessor := mp.New()
-
-		masmaprg := macroProcessor.MacroPass(file)
-		defer masmaprg.Close()
-
-		stackSize := assembler.firstPass(masmaprg)
-
-		definitionTable,
-			useTable, programName, programSize := assembler.secondPass(masmaprg)
-
-		definitionTables = append(definitionTables, definitionTable)
-		useTables = append(useTables, useTable)
-		programNames = append(programNames, programName)
-		programSizes = append(programSizes, programSize)
-		stackSizes = append(stackSizes, stackSize)
-
-		if !isProgramStartSet && shared.ProgramStart != -1 {
-			isProgramStartSet = true
-			shared.ProgramIndexOfStart = len(programNames) - 1
-		}
-	}
-
-	if !isProgramStartSet {
-		panic("faltando indicação de onde começar a execução")
-	}
-	return definitionTables, useTables, programNames, programSizes, stackSizes
-}
-
 func getOpcode(token string) (shared.Operation, error) {
 	allowedInstructions := map[string]shared.Operation{
 		"ADD":    shared.ADD,
@@ -107,7 +83,13 @@ func getOpcode(token string) (shared.Operation, error) {
 	}
 }
 
-func (assembler *Assembler) firstPass(file *os.File) uint16 {
+// reports whether token is a machine instruction mnemonic
+func IsInstruction(token string) bool {
+	_, err := getOpcode(token)
+	return err == nil
+}
+
+func (assembler *Assembler) firstPass(file io.ReadSeeker) uint16 {
 
 	//rewind after macroPass
 	file.Seek(0, 0)
@@ -117,23 +99,22 @@ func (assembler *Assembler) firstPass(file *os.File) uint16 {
 	stackSize := uint16(0)
 	for scanner.Scan() {
 		assembler.lineCounter++
-		line, isComment := parser.ReadLine(scanner)
+		// the length of source lines is checked by the macro processor
+		line, isComment, _ := parser.ReadLine(scanner)
 		if isComment {
 			continue
 		}
+		assembler.currentLine = line
 
 		// if operation is a pseudo-instruction, op2 is always EMPTY
-		label, operationString, op1, op2 := parser.Line(line)
-		op1SymbolErr := validateSymbol(op1)
-
-		if _, ok := assembler.useTable[op1]; ok {
-			assembler.useTable[op1] = append(
-				assembler.useTable[op1], assembler.locationCounter+1)
+		label, operationString, op1, op2, err := parser.Line(line)
+		if err != nil {
+			assembler.addError(shared.CodeLineFormat, err)
 		}
-		if _, ok := assembler.useTable[op2]; ok {
-			assembler.useTable[op2] = append(
-				assembler.useTable[op2], assembler.locationCounter+2)
+		if label != EMPTY {
+			assembler.recordDefinition(label, symbolKind(operationString))
 		}
+		op1SymbolErr := validateSymbol(op1)
 
 		pseudoOpSize, isPseudoInstruction := pseudoOpSizes[operationString]
 		if isPseudoInstruction {
@@ -141,20 +122,20 @@ func (assembler *Assembler) firstPass(file *os.File) uint16 {
 			switch instruction {
 			case "START":
 				if op1 == EMPTY || op2 != EMPTY {
-					assembler.addError(
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
 						errors.New("sintaxe (inválida) na pseudo instrução start"))
 				}
 				if label != EMPTY {
 					assembler.insertIntoProperTable(label)
 				}
 				if op1SymbolErr != nil {
-					assembler.addError(
+					assembler.addErrorAt(shared.CodeSymbol, op1,
 						errors.New("nome do programa inválido na pseudo instrução start"))
 				}
 				assembler.programName = op1
 			case "END":
 				if op1 != EMPTY || op2 != EMPTY {
-					assembler.addError(
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
 						errors.New("sintaxe inválida na pseudo instrução end"))
 				}
 				if label != EMPTY {
@@ -163,7 +144,7 @@ func (assembler *Assembler) firstPass(file *os.File) uint16 {
 				return stackSize
 			case "INTDEF":
 				if op1 == EMPTY || op2 != EMPTY {
-					assembler.addError(
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
 						errors.New("sintaxe inválida na pseudo instrução intdef"))
 				}
 				if label != EMPTY {
@@ -172,50 +153,130 @@ func (assembler *Assembler) firstPass(file *os.File) uint16 {
 				if op1SymbolErr == nil {
 					// if a symbol is defined using intdef,
 					// it should be relocated from the symbolTable
+					if info, defined := assembler.symbolTable[op1]; defined {
+						// defined before the intdef, e.g. by EQU
+						assembler.definitionTable[op1] = info
+					} else {
+						assembler.definitionTable[op1] =
+							shared.SymbolInfo{
+								Address: assembler.locationCounter,
+								Mode:    shared.ABSOLUTE}
+					}
 					delete(assembler.symbolTable, op1)
-					assembler.definitionTable[op1] =
-						shared.SymbolInfo{
-							Address: assembler.locationCounter,
-							Mode:    shared.ABSOLUTE}
 				}
 			case "INTUSE":
 				if label == EMPTY || op1 != EMPTY || op2 != EMPTY {
-					assembler.addError(
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
 						errors.New("sintaxe inválida na pseudo instrução intuse"))
 				}
 				assembler.useTable[label] = []uint16{}
 			case "CONST":
 				if label == EMPTY || op1 == EMPTY || op2 != EMPTY {
-					assembler.addError(
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
 						errors.New("sintaxe inválida na pseudo instrução const"))
 				}
 				assembler.insertIntoProperTable(label)
+				// a constant has no opcode, its value is the word itself
+				assembler.recordExternalUse(op1, assembler.locationCounter)
 			case "SPACE":
-				if label == EMPTY || op1 != EMPTY || op2 != EMPTY {
-					assembler.addError(
+				if label == EMPTY || op2 != EMPTY {
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
 						errors.New("sintaxe inválida na pseudo instrução space"))
 				}
 				assembler.insertIntoProperTable(label)
+				size, err := assembler.spaceSize(op1)
+				if err != nil {
+					assembler.addErrorAt(expressionErrorCode(err), op1, err)
+				} else {
+					pseudoOpSize = size
+				}
+			case "DATA":
+				if op1 == EMPTY || op2 != EMPTY {
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
+						errors.New("sintaxe inválida na pseudo instrução data"))
+					break
+				}
+				if label != EMPTY {
+					assembler.insertIntoProperTable(label)
+				}
+				items, err := dataItems(op1)
+				if err != nil {
+					assembler.addErrorAt(expressionErrorCode(err), op1, err)
+					break
+				}
+				for i, item := range items {
+					assembler.recordExternalUse(
+						item, assembler.locationCounter+uint16(i))
+				}
+				pseudoOpSize = uint16(len(items))
+			case "STRING", "STRINGZ":
+				if op1 == EMPTY || op2 != EMPTY {
+					assembler.addErrorAt(shared.CodeSyntax, operationString, errors.New(
+						"sintaxe inválida na pseudo instrução "+instruction))
+					break
+				}
+				if label != EMPTY {
+					assembler.insertIntoProperTable(label)
+				}
+				words, err := stringWords(instruction, op1)
+				if err != nil {
+					assembler.addErrorAt(expressionErrorCode(err), op1, err)
+					break
+				}
+				pseudoOpSize = uint16(len(words))
 			case "STACK":
 				if op1 == EMPTY || op2 != EMPTY {
-					assembler.addError(
+					assembler.addErrorAt(shared.CodeSyntax, operationString,
 						errors.New("sintaxe inválida na pseudo instrução stack"))
 				}
 				if label != EMPTY {
 					assembler.insertIntoProperTable(label)
 				}
-				intStackSize, err := getOperandValue(op1)
+				if op1 == EMPTY {
+					break
+				}
+				size, err := assembler.evaluateExpression(op1)
+				if err != nil {
+					assembler.addErrorAt(expressionErrorCode(err), op1, err)
+				} else if !size.isAbsolute() || size.value < 0 {
+					assembler.addErrorAt(shared.CodeOperand, op1, errors.New(
+						"tamanho da pilha deve ser um valor absoluto não negativo"))
+				} else {
+					stackSize += uint16(size.value)
+				}
+			case "EQU", "SET":
+				if label == EMPTY || op1 == EMPTY || op2 != EMPTY {
+					assembler.addErrorAt(shared.CodeSyntax, operationString, errors.New(
+						"sintaxe inválida na pseudo instrução "+instruction))
+					break
+				}
+				assembler.defineValue(label, op1, instruction == "SET")
+			case "ORG", "ALIGN", "RESERVE":
+				if op1 == EMPTY || op2 != EMPTY {
+					assembler.addErrorAt(shared.CodeSyntax, operationString, errors.New(
+						"sintaxe inválida na pseudo instrução "+instruction))
+					break
+				}
+				gap, _, err := assembler.gapSize(instruction, op1)
 				if err != nil {
-					panic(err)
+					assembler.addErrorAt(expressionErrorCode(err), op1, err)
+				}
+				// a reserved block starts at its label, ORG and ALIGN
+				// label the address they move to
+				if label != EMPTY && instruction == "RESERVE" {
+					assembler.insertIntoProperTable(label)
+				}
+				assembler.locationCounter += gap
+				if label != EMPTY && instruction != "RESERVE" {
+					assembler.insertIntoProperTable(label)
 				}
-				stackSize += uint16(intStackSize)
 			}
 			assembler.locationCounter += pseudoOpSize
 		} else {
 			opcode, err := getOpcode(operationString)
 			if err != nil {
-				assembler.addError(
-					errors.New("operação " + operationString + " é inválida"))
+				assembler.addErrorAt(shared.CodeUnknownOp, operationString,
+					errors.New("operação "+operationString+" é inválida"))
 			}
 
 			opSize := shared.OpSizes[opcode]
@@ -224,24 +285,27 @@ func (assembler *Assembler) firstPass(file *os.File) uint16 {
 			sizeThreeError := opSize == 3 && (op1 == EMPTY || op2 == EMPTY)
 			invalidSyntax := sizeOneError || sizeTwoError || sizeThreeError
 			if invalidSyntax {
-				assembler.addError(
-					errors.New("sintaxe inválida na operação " + operationString))
+				assembler.addErrorAt(shared.CodeSyntax, operationString,
+					errors.New("sintaxe inválida na operação "+operationString))
 			}
 
 			if len(label) != 0 {
 				assembler.insertIntoProperTable(label)
 			}
 
+			assembler.recordExternalUse(op1, assembler.locationCounter+1)
+			assembler.recordExternalUse(op2, assembler.locationCounter+2)
+
 			assembler.locationCounter += opSize
 		}
 
 	}
 
-	assembler.addError(errors.New("sem instrução \"end\""))
+	assembler.addError(shared.CodeProgram, errors.New("sem instrução \"end\""))
 	return stackSize
 }
 
-func (assembler *Assembler) secondPass(file *os.File) (
+func (assembler *Assembler) secondPass(file io.ReadSeeker) (
 	map[string]shared.SymbolInfo, map[string][]uint16, string, uint16) {
 
 	// File rewind to origin and reset locationCount
@@ -249,24 +313,14 @@ func (assembler *Assembler) secondPass(file *os.File) (
 	assembler.locationCounter = 0
 
 	if assembler.programName == EMPTY {
-		assembler.addError(errors.New("programa sem nome"))
+		assembler.addError(shared.CodeProgram, errors.New("programa sem nome"))
 	}
 
-	objFile, err := shared.CreateBuildFile(assembler.programName + ".obj")
-	if err != nil {
-		panic(err)
-	}
-	defer objFile.Close()
-
-	lstFile, err := shared.CreateBuildFile(assembler.programName + ".lst")
-	if err != nil {
-		panic(err)
-	}
-	defer lstFile.Close()
+	objFile, lstFile := &assembler.object, &assembler.listing
 
 	scanner := bufio.NewScanner(file)
 	assembler.lineCounter = 0
-	assembler.lstLineCounter = 1
+	assembler.writeListingHeader(lstFile)
 	var op1Value, op2Value shared.Word
 	var op1Mode, op2Mode byte
 	var zeroValuedByte byte
@@ -276,16 +330,18 @@ func (assembler *Assembler) secondPass(file *os.File) (
 		assembleLine := false
 		assembler.lineCounter++
 
-		line, isComment := parser.ReadLine(scanner)
+		line, isComment, _ := parser.ReadLine(scanner)
 		if isComment {
 			continue
 		}
+		assembler.currentLine = line
 
 		// method 'assembleLine' needs these values zeroed if unused
 		op1Mode = zeroValuedByte
 		op2Mode = zeroValuedByte
 
-		_, operation, operand1, operand2 := parser.Line(line)
+		// problems with the line itself were reported by the first pass
+		label, operation, operand1, operand2, _ := parser.Line(line)
 
 		//fmt.Printf("%s %s %s\n", operation, operand1, operand2)
 
@@ -300,16 +356,69 @@ func (assembler *Assembler) secondPass(file *os.File) (
 			case "SPACE":
 				opCode = SPACE
 				op1Mode = shared.ABSOLUTE
-				assembleLine = true
+				size, err := assembler.spaceSize(operand1)
+				if err != nil {
+					size = 1
+				}
+				// one line per word, like the linker expects
+				for i := uint16(0); i < size; i++ {
+					assembler.assembleLine(objFile, lstFile, true, opCode,
+						0, op1Mode, 0, op2Mode)
+					assembler.locationCounter++
+				}
+				opSize = 0
+			case "DATA":
+				// errors were reported by the first pass
+				items, err := dataItems(operand1)
+				if err != nil {
+					break
+				}
+				for _, item := range items {
+					value, mode := assembler.getOperandValueAndMode(item)
+					assembler.assembleLine(objFile, lstFile, true, 0,
+						value, mode, 0, op2Mode)
+					assembler.locationCounter++
+				}
+			case "STRING", "STRINGZ":
+				words, err := stringWords(operation, operand1)
+				if err != nil {
+					break
+				}
+				for _, word := range words {
+					assembler.assembleLine(objFile, lstFile, true, 0,
+						word, shared.ABSOLUTE, 0, op2Mode)
+					assembler.locationCounter++
+				}
+			case "SET":
+				// operands after this line see the value set here,
+				// errors were reported by the first pass
+				if value, err := assembler.evaluateExpression(operand1); err == nil {
+					assembler.setValue(label, value)
+				}
+				assembleLine = false
+			case "ORG", "ALIGN", "RESERVE":
+				// errors were reported by the first pass
+				gap, absolute, err := assembler.gapSize(operation, operand1)
+				if err == nil && gap > 0 {
+					assembler.assembleGap(objFile, lstFile, gap)
+					opSize = gap
+				}
+				if err == nil && absolute {
+					assembler.assembleOrigin(objFile, assembler.locationCounter+gap)
+				}
+				assembleLine = false
 			default:
 				assembleLine = false
 			}
 
 		} else {
 			assembleLine = true
+			var err error
 			opCode, err = getOpcode(operation)
 			if err != nil {
-				panic(err)
+				// reported by the first pass
+				assembler.listRemainingLine(lstFile)
+				continue
 			}
 			// redefines opSize
 			opSize = shared.OpSizes[opCode]
@@ -324,7 +433,10 @@ func (assembler *Assembler) secondPass(file *os.File) (
 
 		}
 
-		assembler.addAddressModeToOpcode(&opCode, operand1, operand2)
+		// data directives take values, not addressing modes
+		if !isPseudoInstruction || operation == "CONST" {
+			assembler.addAddressModeToOpcode(&opCode, operand1, operand2)
+		}
 
 		if assembleLine {
 			assembler.assembleLine(
@@ -332,10 +444,14 @@ func (assembler *Assembler) secondPass(file *os.File) (
 				op1Value, op1Mode, op2Value, op2Mode)
 		}
 
+		assembler.listRemainingLine(lstFile)
 		assembler.locationCounter += opSize
 
 	}
+	assembler.listSourceUntil(lstFile, uint16(len(assembler.source)))
 
+	assembler.warnUnusedSymbols()
+	assembler.writeCrossReference(lstFile)
 	assembler.writeErrorsToLst(lstFile)
 
 	// info linker needs
@@ -345,22 +461,106 @@ func (assembler *Assembler) secondPass(file *os.File) (
 		assembler.locationCounter
 }
 
-func (assembler *Assembler) addError(err error) {
-	lineNumber := strconv.Itoa(int(assembler.lineCounter))
-	errString := "erro na linha " + lineNumber + ": " + err.Error() + "\n"
-	assembler.errors = append(assembler.errors, errString)
+// problems refer to the original source, not to the expanded one
+func (assembler *Assembler) addError(code string, err error) {
+	assembler.addDiagnostic(shared.Error, code, EMPTY, err)
+}
+
+// token is the part of the line the error is about, used for its column
+func (assembler *Assembler) addErrorAt(code, token string, err error) {
+	assembler.addDiagnostic(shared.Error, code, token, err)
+}
+
+func (assembler *Assembler) addDiagnostic(
+	severity shared.Severity, code, token string, err error) {
+	text := assembler.originText()
+	column := assembler.column(text, token)
+	var lineErr *parser.LineError
+	if errors.As(err, &lineErr) {
+		// the column is in the current line, which may differ from the source
+		extra := strings.Fields(assembler.currentLine[lineErr.Column-1:])
+		column = assembler.column(text, extra[0])
+	}
+
+	origin := assembler.origin()
+	assembler.diagnostics = append(assembler.diagnostics, shared.Diagnostic{
+		File:       origin.File,
+		Line:       int(origin.Line),
+		Column:     column,
+		Severity:   severity,
+		Code:       code,
+		Message:    err.Error(),
+		Expansions: origin.Expansions})
+}
+
+// where the current line came from. Falls back to lineCounter when the file
+// did not go through the macro processor.
+func (assembler *Assembler) origin() mp.Origin {
+	idx := int(assembler.lineCounter) - 1
+	if idx >= 0 && idx < len(assembler.origins) {
+		return assembler.origins[idx]
+	}
+	return mp.Origin{File: assembler.filePath, Line: assembler.lineCounter}
+}
+
+// line of the current line in the file it came from, which may be included
+func (assembler *Assembler) sourceLine() uint16 {
+	return assembler.origin().Line
+}
+
+// lines of file, which is either the one being assembled or one it
+// included, as the macro processor read them
+func (assembler *Assembler) sourceOf(file string) []string {
+	if file == assembler.filePath {
+		return assembler.source
+	}
+	return assembler.includedSources[file]
+}
+
+// the text of line in file, if the file could be read
+func (assembler *Assembler) sourceText(file string, line uint16) (string, bool) {
+	source := assembler.sourceOf(file)
+	if line < 1 || int(line) > len(source) {
+		return EMPTY, false
+	}
+	return source[line-1], true
 }
 
-func (assembler *Assembler) writeErrorsToLst(lstFile *os.File) {
-	if len(assembler.errors) == 0 {
-		_, err := lstFile.WriteString("Nenhum erro detectado.\n")
+// the source line the current line came from, or the current line itself
+// when the source did not go through the macro processor
+func (assembler *Assembler) originText() string {
+	origin := assembler.origin()
+	if text, ok := assembler.sourceText(origin.File, origin.Line); ok && assembler.origins != nil {
+		return text
+	}
+	return assembler.currentLine
+}
+
+// column of token in text, 1 when it is not there (for example in a line
+// produced by a macro expansion)
+func (assembler *Assembler) column(text, token string) int {
+	index := strings.Index(text, token)
+	if token == EMPTY || index < 0 {
+		return 1
+	}
+	return utf8.RuneCountInString(text[:index]) + 1
+}
+
+func (assembler *Assembler) writeErrorsToLst(lstFile io.Writer) {
+	if len(assembler.diagnostics) == 0 {
+		_, err := io.WriteString(lstFile, "Nenhum erro detectado.\n")
 		if err != nil {
 			panic(err)
 		}
 		return
 	}
-	for _, errorString := range assembler.errors {
-		_, err := lstFile.WriteString(errorString)
+	for _, diagnostic := range assembler.diagnostics {
+		place := ""
+		if diagnostic.File != assembler.filePath {
+			place = " de " + filepath.Base(diagnostic.File)
+		}
+		_, err := fmt.Fprintf(lstFile, "%v na linha %d%s: %s%s\n", diagnostic.Severity,
+			diagnostic.Line, place, diagnostic.Message, diagnostic.Backtrace())
 		if err != nil {
 			panic(err)
 		}
@@ -372,7 +572,7 @@ func (assembler *Assembler) addAddressModeToOpcode(
 	if operand1 != EMPTY {
 		op1AddressMode, err := getAddressMode(operand1)
 		if err != nil {
-			assembler.addError(err)
+			assembler.addErrorAt(shared.CodeOperand, operand1, err)
 		}
 		if op1AddressMode == shared.DIRECT {
 			*opCode += 0b01_00 << 5
@@ -386,7 +586,7 @@ func (assembler *Assembler) addAddressModeToOpcode(
 	if operand2 != EMPTY {
 		op2AddressMode, err := getAddressMode(operand2)
 		if err != nil {
-			assembler.addError(err)
+			assembler.addErrorAt(shared.CodeOperand, operand2, err)
 		}
 		if op2AddressMode == shared.DIRECT {
 			*opCode += 0b00_01 << 5
@@ -401,60 +601,98 @@ func (assembler *Assembler) addAddressModeToOpcode(
 
 // checks if mode is unset to see if operands are being used, ignores them if needed
 func (assembler *Assembler) assembleLine(
-	objFile *os.File, lstFile *os.File, isPseudoInstruction bool,
+	objFile, lstFile io.Writer, isPseudoInstruction bool,
 	opCode shared.Operation, op1Value shared.Word, op1Mode byte,
 	op2Value shared.Word, op2Mode byte) {
-	var objLine string
-	var lstLine string = fmt.Sprintf("%02d ", assembler.locationCounter)
+	var words string
 	var zeroValuedByte byte
 	smallPadding := "    "
-	padding := "     "
 
 	if !isPseudoInstruction {
-		opCodeString := fmt.Sprintf("%02d ", opCode)
-		objLine += opCodeString
-		lstLine += opCodeString
-	} else {
-		objLine += smallPadding
-		lstLine += smallPadding
+		words += fmt.Sprintf("%02d ", opCode)
 	}
 
 	if op1Mode != zeroValuedByte {
-		var op1String string
 		if opCode == SPACE {
-			op1String = "XX A "
+			words += "XX A "
 		} else {
-			op1String = fmt.Sprintf("%02d %c ", op1Value, op1Mode)
+			words += fmt.Sprintf("%02d %c ", op1Value, op1Mode)
 		}
-		objLine += op1String
-		lstLine += op1String
-	} else {
-		lstLine += padding + " "
 	}
 	if op2Mode != zeroValuedByte {
-		op2String := fmt.Sprintf("%02d %c ", op2Value, op2Mode)
-		objLine += op2String
-		lstLine += op2String
-	} else {
-		lstLine += padding
+		words += fmt.Sprintf("%02d %c ", op2Value, op2Mode)
 	}
 
-	lstLine += fmt.Sprintf("%02d %02d", assembler.lstLineCounter, assembler.lineCounter)
+	objLine := words + "\n"
+	if isPseudoInstruction {
+		objLine = smallPadding + objLine
+	}
+	_, err := io.WriteString(objFile, objLine)
+	if err != nil {
+		panic(err)
+	}
 
-	objLine += "\n"
-	lstLine += "\n"
+	assembler.recordDebugLine()
+	assembler.listWords(lstFile, strings.TrimSpace(words))
+}
 
-	_, err := objFile.WriteString(objLine)
+// a gap is written to the object as "GAP n", the linker fills it with zeros
+func (assembler *Assembler) assembleGap(objFile, lstFile io.Writer, size uint16) {
+	_, err := fmt.Fprintf(objFile, "GAP %d\n", size)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = lstFile.WriteString(lstLine)
+	assembler.recordDebugLine()
+	assembler.listWords(lstFile, fmt.Sprintf("GAP %d", size))
+}
+
+// an ORG to a number is written as "ORG n A" after its gap, so the linker
+// can check the module was placed where the address still holds
+func (assembler *Assembler) assembleOrigin(objFile io.Writer, address uint16) {
+	_, err := fmt.Fprintf(objFile, "ORG %d A\n", address)
 	if err != nil {
 		panic(err)
 	}
+}
 
-	assembler.lstLineCounter++
+// number of words skipped by ORG, ALIGN or RESERVE at the current address.
+// ORG takes an address inside the module, either a number or an expression
+// on its labels, and can only move forward. absolute tells an ORG to a
+// number, which only holds if the module is linked where it was assembled.
+func (assembler *Assembler) gapSize(instruction, operand string) (
+	gap uint16, absolute bool, err error) {
+
+	value, err := assembler.evaluateExpression(operand)
+	if err != nil {
+		return 0, false, err
+	}
+	if value.external != EMPTY {
+		return 0, false, errors.New("operando externo na pseudo instrução " + instruction)
+	}
+	if instruction != "ORG" && value.mode != shared.ABSOLUTE {
+		return 0, false, errors.New("operando relocável na pseudo instrução " + instruction)
+	}
+
+	switch instruction {
+	case "ORG":
+		if value.value < int(assembler.locationCounter) {
+			return 0, false, errors.New("org não pode voltar para um endereço anterior")
+		}
+		return uint16(value.value) - assembler.locationCounter,
+			value.mode == shared.ABSOLUTE, nil
+	case "ALIGN":
+		if value.value <= 0 {
+			return 0, false, errors.New("alinhamento deve ser positivo")
+		}
+		alignment := uint16(value.value)
+		return (alignment - assembler.locationCounter%alignment) % alignment, false, nil
+	default:
+		if value.value < 0 {
+			return 0, false, errors.New("tamanho reservado não pode ser negativo")
+		}
+		return uint16(value.value), false, nil
+	}
 }
 
 func getOperandValue(operand string) (shared.Word, error) {
@@ -462,93 +700,58 @@ func getOperandValue(operand string) (shared.Word, error) {
 		return shared.Word(0), errors.New("operando vazio usado em getOperandValue")
 	}
 
-	var value int64
-	var err error
-	operand, err = removeAddressMode(operand)
+	operand, err := removeAddressMode(operand)
 	if err != nil {
 		return shared.Word(0), err
 	}
-	apostrophe := byte('\'')
-	isHexadecimal := operand[0] == 'H' && len(operand) > 3
-	isLiteral := operand[0] == '@' && len(operand) > 1
-	switch {
-	case isHexadecimal:
-		if operand[1] != apostrophe && operand[len(operand)-1] != apostrophe {
-			return 0, errors.New("faltando apostrofos em número hexadecimal")
-		}
-		hexString := operand[2 : len(operand)-1]
-		value, err = strconv.ParseInt(hexString, 16, shared.WordSize)
-		if err != nil {
-			return 0, errors.New("número hexadecimal inválido")
-		}
-
-	case isLiteral:
-		operand, err = removeAddressMode(operand)
-		if err != nil {
-			return 0, err
-		}
-		// if is char literal
-		if len(operand) > 3 {
-			if operand[1] == apostrophe && operand[3] == apostrophe {
-				value = int64(operand[2]) - '0'
-				if value < 0 {
-					return 0, errors.New("converção de literal inválida")
-				}
-				return shared.Word(value), nil
-			}
-		}
-		operand = operand[1:]
-		value, err = strconv.ParseInt(operand, 10, shared.WordSize)
-		if err != nil {
-			return 0, errors.New("literal decimal inválido")
-		}
-	default:
-		value, err = strconv.ParseInt(operand, 10, shared.WordSize)
-		if err != nil {
-			return 0, errors.New("número " + operand + " não reconhecido")
-		}
+	value, err := parser.LiteralValue(operand, shared.WordSize)
+	if err != nil {
+		return shared.Word(0), err
 	}
 
 	return shared.Word(value), nil
 }
 
-// assumes operand is not empty
+// assumes operand is not empty. An operand referring to an INTUSE symbol is
+// absolute and holds only the offset, the linker adds the symbol's address.
 func (assembler *Assembler) getOperandValueAndMode(operand string) (
 	value shared.Word, mode byte) {
-	if err := validateSymbol(operand); err == nil {
-		// Is a label
-		infoSym, okSym := assembler.symbolTable[operand]
-		infoDef, okDef := assembler.definitionTable[operand]
-
-		_, okUse := assembler.useTable[operand]
-
-		// TODO: Check if can be in multiple tables
-		// if (okSymbol && okUse) || (okSymbol && okDef) || (okDef && okUse) {
-		// 	assembler.addError(
-		// 		errors.New("label " + operand1 + " defined in multiple tables"))
-		// }
-
-		if okSym {
-			value = shared.Word(infoSym.Address)
-			mode = infoSym.Mode
-		} else if okUse {
-			// ?
-			value = 0
-			mode = 'A'
-		} else if okDef {
-			value = shared.Word(infoDef.Address)
-			mode = infoDef.Mode
-		}
-	} else {
-		// Is a number
-		value, err = getOperandValue(operand)
-		if err != nil {
-			panic(err)
-		}
-		mode = 'A'
+	// invalid address modes are reported by addAddressModeToOpcode
+	expression, err := removeAddressMode(operand)
+	if err != nil {
+		return 0, shared.ABSOLUTE
+	}
+
+	result, err := assembler.evaluateExpression(expression)
+	if err != nil {
+		assembler.addErrorAt(expressionErrorCode(err), operand, err)
+		return 0, shared.ABSOLUTE
+	}
+
+	return shared.Word(result.value), result.mode
+}
+
+// records address as a use of the INTUSE symbol in operand, if there is one
+func (assembler *Assembler) recordExternalUse(operand string, address uint16) {
+	if operand == EMPTY {
+		return
+	}
+	expression, err := removeAddressMode(operand)
+	if err != nil {
+		return
+	}
+	// errors are reported when the operand is evaluated in the second pass
+	tokens, err := parser.ExpressionTokens(expression)
+	if err != nil {
+		return
 	}
 
-	return value, mode
+	for _, token := range tokens {
+		if uses, ok := assembler.useTable[token]; ok {
+			assembler.useTable[token] = append(uses, address)
+			return
+		}
+	}
 }
 
 func removeAddressMode(operand string) (string, error) {
@@ -612,18 +815,68 @@ func validateSymbol(symbol string) error {
 	return nil
 }
 
+// defines symbol with the value of expression instead of the current
+// address. Only symbols defined by SET may be defined again, and only by SET.
+func (assembler *Assembler) defineValue(symbol, expression string, redefinable bool) {
+	if err := validateSymbol(symbol); err != nil {
+		assembler.addErrorAt(shared.CodeSymbol, symbol, err)
+		return
+	}
+
+	value, err := assembler.evaluateExpression(expression)
+	if err != nil {
+		assembler.addErrorAt(expressionErrorCode(err), expression, err)
+		return
+	}
+	if value.external != EMPTY {
+		assembler.addErrorAt(shared.CodeOperand, expression, errors.New(
+			"símbolo "+symbol+" não pode ser definido por símbolo externo"))
+		return
+	}
+
+	_, defined := assembler.symbolTable[symbol]
+	isSet, isValue := assembler.valueSymbols[symbol]
+	if info, ok := assembler.definitionTable[symbol]; ok &&
+		(info.Mode == shared.RELATIVE || isValue) {
+		defined = true
+	}
+	if defined && !(redefinable && isSet) {
+		assembler.addErrorAt(shared.CodeSymbol, symbol,
+			errors.New("símbolo "+symbol+" com múltiplas definições."))
+		return
+	}
+	assembler.valueSymbols[symbol] = redefinable
+
+	assembler.setValue(symbol, value)
+}
+
+func (assembler *Assembler) setValue(symbol string, value expressionValue) {
+	info := shared.SymbolInfo{Address: uint16(value.value), Mode: value.mode}
+	assembler.symbolTable[symbol] = info
+	if _, ok := assembler.definitionTable[symbol]; ok {
+		assembler.definitionTable[symbol] = info
+	}
+}
+
 // checks for validity
 func (assembler *Assembler) insertIntoProperTable(symbol string) {
 	err := validateSymbol(symbol)
 	if err != nil {
-		assembler.addError(err)
+		assembler.addErrorAt(shared.CodeSymbol, symbol, err)
 	}
 	if symbol == assembler.programName {
-		if shared.ProgramStart != 0 {
-			assembler.addError(
+		if assembler.programStart != -1 {
+			assembler.addErrorAt(shared.CodeProgram, symbol,
 				errors.New("multiplos lugares com a label de começo de execução"))
 		}
-		shared.ProgramStart = int(assembler.locationCounter)
+		assembler.programStart = int(assembler.locationCounter)
+	}
+
+	// a value from EQU or SET is not replaced by an address
+	if _, isValue := assembler.valueSymbols[symbol]; isValue {
+		assembler.addErrorAt(shared.CodeSymbol, symbol,
+			errors.New("símbolo "+symbol+" com múltiplas definições."))
+		return
 	}
 
 	// if its defined and it is its first use, set its address to current address
@@ -639,8 +892,8 @@ func (assembler *Assembler) insertIntoProperTable(symbol string) {
 
 	_, ok = assembler.symbolTable[symbol]
 	if ok {
-		assembler.addError(
-			errors.New("símbolo " + symbol + " com múltiplas definições."))
+		assembler.addErrorAt(shared.CodeSymbol, symbol,
+			errors.New("símbolo "+symbol+" com múltiplas definições."))
 	}
 	assembler.symbolTable[symbol] =
 		shared.SymbolInfo{
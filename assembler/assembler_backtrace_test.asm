@@ -0,0 +1,17 @@
+ START MAIN
+ MACRO
+ TWICE &X
+ ONCE &X
+ ONCE &X
+ MEND
+*
+ MACRO
+ ONCE &X
+ BOGUS &X
+ MEND
+*
+MAIN LOAD A
+ TWICE A
+ STOP
+A CONST 1
+ END
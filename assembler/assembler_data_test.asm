@@ -0,0 +1,11 @@
+      START  DATAS
+EXT   INTUSE
+N     EQU    3
+DATAS LOAD   LIST
+      STOP
+LIST  DATA   1,N*2,@'5',EXT+1
+MSG   STRING 'HI YOU'
+ZMSG  STRINGZ 'IT''S'
+BUF   SPACE  N
+ONE   SPACE
+      END
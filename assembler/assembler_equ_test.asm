@@ -0,0 +1,15 @@
+      START  EQUS
+      INTDEF TEN
+TEN   EQU    2*5
+SIZE  EQU    4
+      INTDEF SIZE
+COUNT SET    1
+COUNT SET    COUNT+1
+      STACK  SIZE
+EQUS  LOAD   #TEN
+      ADD    TAB+SIZE-1
+      STOP
+TAB   CONST  COUNT
+COUNT SET    COUNT+1
+TAB2  CONST  COUNT
+      END
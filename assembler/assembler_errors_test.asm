@@ -0,0 +1,7 @@
+      START  ERRS
+ERRS  LOAD   #12A
+      FOO    1
+      ADD    X Y Z
+      STACK  ERRS
+      STOP
+      END
@@ -0,0 +1,5 @@
+* constantes compartilhadas
+*
+K     CONST  5
+      ADD    K
+      LOAD   NOPE
@@ -0,0 +1,5 @@
+      START  INC
+INC   LOAD   K
+      INCLUDE 'assembler_include_defs.asm'
+      STOP
+      END
@@ -0,0 +1,14 @@
+* programa de teste
+      START  LST
+      MACRO
+      SOMA   &A &B
+      LOAD   &A
+      ADD    &B
+      MEND
+*
+LST   LOAD   X
+      SOMA   X Y
+      STOP
+X     CONST  1
+Y     DATA   2,3
+      END
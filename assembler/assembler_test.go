@@ -1,11 +1,16 @@
 package assembler
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"reflect"
+	"saturn/mp"
 	"saturn/shared"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -322,3 +327,444 @@ func TestRemoveAddressMode(t *testing.T) {
 		t.Fatalf("esperava-se operando @H'3F, recebeu-se %v", operand)
 	}
 }
+
+func TestEvaluateExpression(t *testing.T) {
+	assembler := New()
+	assembler.symbolTable["TABLE"] = shared.SymbolInfo{Address: 10, Mode: shared.RELATIVE}
+	assembler.symbolTable["END"] = shared.SymbolInfo{Address: 14, Mode: shared.RELATIVE}
+	assembler.symbolTable["SIZE"] = shared.SymbolInfo{Address: 4, Mode: shared.ABSOLUTE}
+	assembler.useTable["EXT"] = []uint16{}
+
+	valid := []struct {
+		expression string
+		value      int
+		mode       byte
+		external   string
+	}{
+		{"TABLE+3", 13, shared.RELATIVE, EMPTY},
+		{"3+TABLE", 13, shared.RELATIVE, EMPTY},
+		{"TABLE-1", 9, shared.RELATIVE, EMPTY},
+		{"END-TABLE", 4, shared.ABSOLUTE, EMPTY},
+		{"TABLE+SIZE*2", 18, shared.RELATIVE, EMPTY},
+		{"(2+3)*4", 20, shared.ABSOLUTE, EMPTY},
+		{"H'10'/2", 8, shared.ABSOLUTE, EMPTY},
+		{"-5+3", -2, shared.ABSOLUTE, EMPTY},
+		{"EXT", 0, shared.ABSOLUTE, "EXT"},
+		{"EXT+2", 2, shared.ABSOLUTE, "EXT"},
+		{"EXT-1", -1, shared.ABSOLUTE, "EXT"},
+	}
+	for _, v := range valid {
+		result, err := assembler.evaluateExpression(v.expression)
+		if err != nil {
+			t.Fatalf("expressão %v gerou erro: %v", v.expression, err)
+		}
+		if result.value != v.value || result.mode != v.mode || result.external != v.external {
+			t.Fatalf("expressão %v: esperava-se %v %c %v, obteve-se %v %c %v",
+				v.expression, v.value, v.mode, v.external,
+				result.value, result.mode, result.external)
+		}
+	}
+
+	invalid := []string{
+		"TABLE+END", "2-TABLE", "TABLE*2", "-TABLE", "EXT+EXT",
+		"EXT+TABLE", "1-EXT", "1/0", "(1+2", "1+", "UNDEF", "40000",
+	}
+	for _, expression := range invalid {
+		if _, err := assembler.evaluateExpression(expression); err == nil {
+			t.Fatalf("expressão inválida %v não gerou erro", expression)
+		}
+	}
+}
+
+func TestEquAndSet(t *testing.T) {
+	file, err := os.Open("assembler_equ_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	assembler := New()
+
+	stackSize := assembler.firstPass(file)
+	if stackSize != 4 {
+		t.Fatalf("esperava-se pilha de tamanho 4, obteve-se %v", stackSize)
+	}
+
+	expected := map[string]shared.SymbolInfo{
+		"TEN":  {Address: 10, Mode: shared.ABSOLUTE},
+		"SIZE": {Address: 4, Mode: shared.ABSOLUTE},
+	}
+	for label, want := range expected {
+		if info := assembler.definitionTable[label]; info != want {
+			t.Fatalf("%v na tabela de definições: esperava-se %v, obteve-se %v",
+				label, want, info)
+		}
+	}
+	if info := assembler.symbolTable["COUNT"]; info.Address != 3 || info.Mode != shared.ABSOLUTE {
+		t.Fatalf("COUNT deveria valer 3 ao fim do primeiro passo, vale %v", info)
+	}
+
+	assembler.secondPass(file)
+	if shared.HasErrors(assembler.diagnostics) {
+		t.Fatalf("erros inesperados: %v", assembler.diagnostics)
+	}
+
+	// STACK still takes one word, so EQUS starts at 1 and TAB at 6
+	lines := strings.Split(strings.TrimSpace(assembler.object.String()), "\n")
+	want := []string{"387 10 A", "130 09 R", "11", "02 A", "03 A"}
+	if len(lines) != len(want) {
+		t.Fatalf("esperava-se %v linhas no objeto, obteve-se %v", len(want), lines)
+	}
+	for i := range want {
+		if strings.Join(strings.Fields(lines[i]), " ") != want[i] {
+			t.Fatalf("linha %v do objeto: esperava-se %q, obteve-se %q",
+				i+1, want[i], lines[i])
+		}
+	}
+
+	assembler = New()
+	assembler.defineValue("X", "1", false)
+	assembler.defineValue("X", "2", false)
+	assembler.defineValue("Y", "1", true)
+	assembler.defineValue("Y", "2", true)
+	assembler.defineValue("Y", "3", false)
+	assembler.defineValue("Z", "UNDEF", false)
+	if len(assembler.diagnostics) != 3 {
+		t.Fatalf("esperava-se 3 erros, obteve-se %v", assembler.diagnostics)
+	}
+}
+
+func TestLabelOnValueSymbol(t *testing.T) {
+	source := `      START  DUPS
+SIZE  EQU    4
+DUPS  LOAD   #SIZE
+SIZE  STOP
+      ADD    #SIZE
+      END
+`
+	modules, diagnostics := Assemble(mp.Options{},
+		Source{Name: "dups.asm", Reader: strings.NewReader(source)})
+	if len(diagnostics) != 1 || diagnostics[0].Line != 4 || diagnostics[0].Code != shared.CodeSymbol {
+		t.Fatalf("esperava-se múltiplas definições na linha 4, obteve-se %v", diagnostics)
+	}
+
+	// SIZE keeps its value after the label on STOP is refused
+	lines := strings.Split(strings.TrimSpace(modules[0].Object), "\n")
+	if last := strings.Fields(lines[len(lines)-1]); len(last) != 3 || last[1] != "04" || last[2] != "A" {
+		t.Fatalf("ADD #SIZE deveria usar o valor 4, obteve-se %v", lines)
+	}
+}
+
+func TestGapSize(t *testing.T) {
+	assembler := New()
+	assembler.symbolTable["TAB"] = shared.SymbolInfo{Address: 10, Mode: shared.RELATIVE}
+	assembler.locationCounter = 6
+
+	valid := []struct {
+		instruction string
+		operand     string
+		gap         uint16
+		absolute    bool
+	}{
+		{"ORG", "6", 0, true},
+		{"ORG", "9", 3, true},
+		{"ORG", "TAB+2", 6, false},
+		{"ALIGN", "4", 2, false},
+		{"ALIGN", "3", 0, false},
+		{"RESERVE", "5", 5, false},
+	}
+	for _, v := range valid {
+		gap, absolute, err := assembler.gapSize(v.instruction, v.operand)
+		if err != nil {
+			t.Fatalf("%v %v gerou erro: %v", v.instruction, v.operand, err)
+		}
+		if gap != v.gap || absolute != v.absolute {
+			t.Fatalf("%v %v: esperava-se %v palavras (absoluto: %v), obteve-se %v (%v)",
+				v.instruction, v.operand, v.gap, v.absolute, gap, absolute)
+		}
+	}
+
+	invalid := []struct {
+		instruction string
+		operand     string
+	}{
+		{"ORG", "5"}, {"ALIGN", "0"}, {"ALIGN", "TAB"},
+		{"RESERVE", "-1"}, {"RESERVE", "TAB"},
+	}
+	for _, v := range invalid {
+		if _, _, err := assembler.gapSize(v.instruction, v.operand); err == nil {
+			t.Fatalf("%v %v não gerou erro", v.instruction, v.operand)
+		}
+	}
+}
+
+func TestDataDirectives(t *testing.T) {
+	file, err := os.Open("assembler_data_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	assembler := New()
+	assembler.firstPass(file)
+
+	addresses := map[string]uint16{
+		"LIST": 3, "MSG": 7, "ZMSG": 14, "BUF": 19, "ONE": 22,
+	}
+	for label, address := range addresses {
+		if info := assembler.symbolTable[label]; info.Address != address {
+			t.Fatalf("%v: esperava-se endereço %v, obteve-se %v",
+				label, address, info.Address)
+		}
+	}
+	if uses := assembler.useTable["EXT"]; len(uses) != 1 || uses[0] != 6 {
+		t.Fatalf("uso de EXT deveria estar no endereço 6, obteve-se %v", uses)
+	}
+
+	assembler.secondPass(file)
+	if shared.HasErrors(assembler.diagnostics) {
+		t.Fatalf("erros inesperados: %v", assembler.diagnostics)
+	}
+
+	var values []string
+	for _, line := range strings.Split(strings.TrimSpace(assembler.object.String()), "\n")[2:] {
+		values = append(values, strings.Fields(line)[0])
+	}
+	want := "01 06 05 01 06 72 73 32 89 79 85 73 84 39 83 00 XX XX XX XX"
+	if strings.Join(values, " ") != want {
+		t.Fatalf("esperava-se dados %v, obteve-se %v", want, values)
+	}
+}
+
+func TestStringWords(t *testing.T) {
+	words, err := stringWords("STRING", "'AB'")
+	if err != nil || len(words) != 3 || words[0] != 2 || words[1] != 'A' {
+		t.Fatalf("STRING 'AB' gerou %v, %v", words, err)
+	}
+	words, err = stringWords("STRINGZ", "''''")
+	if err != nil || len(words) != 2 || words[0] != '\'' || words[1] != 0 {
+		t.Fatalf("STRINGZ '''' gerou %v, %v", words, err)
+	}
+
+	for _, operand := range []string{"AB", "'AB", "'A'B'", "'"} {
+		if _, err := stringWords("STRING", operand); err == nil {
+			t.Fatalf("texto inválido %v não gerou erro", operand)
+		}
+	}
+
+	items, err := dataItems("1,@',',X")
+	if err != nil || len(items) != 3 || items[1] != "@','" {
+		t.Fatalf("lista 1,@',',X gerou %v, %v", items, err)
+	}
+	if _, err := dataItems("1,,2"); err == nil {
+		t.Fatalf("lista com item vazio não gerou erro")
+	}
+}
+
+// assembles the files in paths in memory
+func assembleFiles(paths ...string) ([]Module, []shared.Diagnostic) {
+	sources, diagnostics := ReadSources(paths...)
+	modules, assembleDiagnostics := Assemble(mp.Options{}, sources...)
+	return modules, append(diagnostics, assembleDiagnostics...)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("falha de leitura")
+}
+
+func TestParallelAssembly(t *testing.T) {
+	paths := []string{"assembler_listing_test.asm", "assembler_errors_test.asm",
+		"assembler_backtrace_test.asm", "assembler_equ_test.asm", "assembler_data_test.asm"}
+	sources := func() []Source {
+		sources, _ := ReadSources(paths...)
+		// a source that can't be read is left out, the others keep their order
+		return slices.Insert(sources, 2, Source{Name: "falha.asm", Reader: failingReader{}})
+	}
+
+	modules, diagnostics := AssembleWithWorkers(mp.Options{}, 1, sources()...)
+	var names []string
+	for _, module := range modules {
+		names = append(names, module.Name)
+	}
+	if !slices.Equal(names, []string{"LST", "ERRS", "MAIN", "EQUS", "DATAS"}) {
+		t.Fatalf("módulos fora de ordem: %v", names)
+	}
+	var unreadable []string
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Code == shared.CodeIO {
+			unreadable = append(unreadable, diagnostic.File)
+		}
+	}
+	if !slices.Equal(unreadable, []string{"falha.asm"}) {
+		t.Fatalf("esperava-se erro de leitura em falha.asm, obteve-se %v", diagnostics)
+	}
+
+	for _, workers := range []int{0, 3, 16} {
+		parallelModules, parallelDiagnostics := AssembleWithWorkers(mp.Options{}, workers, sources()...)
+		if !reflect.DeepEqual(parallelModules, modules) ||
+			!reflect.DeepEqual(parallelDiagnostics, diagnostics) {
+			t.Fatalf("com %d montadores o resultado mudou: %v", workers, parallelDiagnostics)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	_, diagnostics := assembleFiles("assembler_errors_test.asm")
+
+	// an error expected in each line
+	expected := []struct {
+		line, column int
+		code         string
+	}{
+		{2, 14, shared.CodeOperand},
+		{3, 7, shared.CodeUnknownOp},
+		{4, 18, shared.CodeLineFormat},
+		{4, 14, shared.CodeUndefinedSymbol},
+		{5, 14, shared.CodeOperand},
+	}
+	for _, position := range expected {
+		found := false
+		for _, diagnostic := range diagnostics {
+			if diagnostic.Line == position.line && diagnostic.Column == position.column &&
+				diagnostic.Severity == shared.Error && diagnostic.Code == position.code &&
+				diagnostic.File == "assembler_errors_test.asm" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("faltando erro %v na linha %v, coluna %v: %v",
+				position.code, position.line, position.column, diagnostics)
+		}
+	}
+}
+
+func TestDiagnosticsInExpansions(t *testing.T) {
+	modules, diagnostics := assembleFiles("assembler_backtrace_test.asm")
+
+	// BOGUS is reached through each ONCE of TWICE, called by line 14
+	var backtraces []string
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Code == shared.CodeUnknownOp && diagnostic.Line == 14 {
+			backtraces = append(backtraces, diagnostic.Backtrace())
+		}
+	}
+	expected := []string{
+		" em TWICE (assembler_backtrace_test.asm:4) > ONCE (assembler_backtrace_test.asm:10)",
+		" em TWICE (assembler_backtrace_test.asm:5) > ONCE (assembler_backtrace_test.asm:10)",
+	}
+	if !slices.Equal(backtraces, expected) {
+		t.Fatalf("esperava-se %q, obteve-se %v", expected, diagnostics)
+	}
+
+	listing := modules[0].Listing
+	if !strings.Contains(listing, "erro na linha 14: operação BOGUS é inválida"+expected[0]) {
+		t.Fatalf("o erro com as expansões não está na listagem:\n%s", listing)
+	}
+}
+
+func TestCrossReference(t *testing.T) {
+	file, err := os.Open("assembler_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	assembler := New()
+	assembler.firstPass(file)
+	assembler.secondPass(file)
+
+	expected := map[string]struct {
+		kind       string
+		line       uint16
+		references []uint16
+	}{
+		"SIG":  {"local", 7, []uint16{9, 11}},
+		"UP":   {"CONST", 10, []uint16{7}},
+		"LOOP": {"INTUSE", 5, []uint16{8}},
+		"X":    {"INTUSE", 6, nil},
+	}
+	for symbol, want := range expected {
+		usage := assembler.usages[symbol]
+		if usage == nil || usage.kind != want.kind || usage.line != want.line ||
+			len(usage.references) != len(want.references) {
+			t.Fatalf("%v: esperava-se %v, obteve-se %v", symbol, want, usage)
+		}
+		for _, line := range want.references {
+			if !usage.references[line] {
+				t.Fatalf("%v: faltando referência na linha %v", symbol, line)
+			}
+		}
+	}
+
+	var warnings []shared.Diagnostic
+	for _, diagnostic := range assembler.diagnostics {
+		if diagnostic.Severity == shared.Warning {
+			warnings = append(warnings, diagnostic)
+		}
+	}
+	if len(warnings) != 1 || warnings[0].Code != shared.CodeUnusedSymbol ||
+		warnings[0].Line != 6 {
+		t.Fatalf("esperava-se aviso de X não usado na linha 6, obteve-se %v", warnings)
+	}
+}
+
+func TestIncludedLines(t *testing.T) {
+	modules, diagnostics := assembleFiles("assembler_include_test.asm")
+
+	// NOPE is missing on line 5 of the included file
+	var errors []shared.Diagnostic
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == shared.Error {
+			errors = append(errors, diagnostic)
+		}
+	}
+	if len(errors) != 1 || errors[0].File != "assembler_include_defs.asm" ||
+		errors[0].Line != 5 || errors[0].Code != shared.CodeUndefinedSymbol {
+		t.Fatalf("esperava-se NOPE indefinido na linha 5 do arquivo incluído, obteve-se %v",
+			diagnostics)
+	}
+
+	// included lines follow the INCLUDE with their own numbers and a "=",
+	// while the symbol table refers to them by the INCLUDE line
+	lst := modules[0].Listing
+	lines := strings.Split(lst, "\n")
+	want := []string{
+		"                          3        INCLUDE 'assembler_include_defs.asm'",
+		"02   05 A                 3= K     CONST  5",
+		"03   130 02 R             4=       ADD    K",
+		"K            02    R CONST      3  2 3",
+	}
+	for _, line := range want {
+		if !slices.Contains(lines, line) {
+			t.Fatalf("faltando linha %q na listagem:\n%s", line, lst)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	modules, diagnostics := assembleFiles("assembler_listing_test.asm")
+	if shared.HasErrors(diagnostics) {
+		t.Fatalf("erros inesperados: %v", diagnostics)
+	}
+
+	lst := modules[0].Listing
+	lines := strings.Split(lst, "\n")
+
+	// location, words, source line and text, with "+" on expanded lines
+	want := []string{
+		"                          1  * programa de teste",
+		"00   131 07 R             9  LST   LOAD   X",
+		"                         10        SOMA   X Y",
+		"02   131 07 R            10+  LOAD X",
+		"04   130 08 R            10+  ADD Y",
+		"08   02 A                13  Y     DATA   2,3",
+		"09   03 A",
+	}
+	for _, line := range want {
+		if !slices.Contains(lines, line) {
+			t.Fatalf("faltando linha %q na listagem:\n%s", line, lst)
+		}
+	}
+}
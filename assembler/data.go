@@ -0,0 +1,73 @@
+package assembler
+
+import (
+	"errors"
+	"saturn/shared"
+)
+
+// splits a DATA operand on the commas outside apostrophes, so character
+// literals such as @',' stay whole
+func dataItems(operand string) ([]string, error) {
+	var items []string
+	quoted := false
+	start := 0
+	for i, v := range operand {
+		switch {
+		case v == '\'':
+			quoted = !quoted
+		case v == ',' && !quoted:
+			items = append(items, operand[start:i])
+			start = i + 1
+		}
+	}
+	items = append(items, operand[start:])
+
+	for _, item := range items {
+		if item == EMPTY {
+			return nil, errors.New("item vazio na pseudo instrução data")
+		}
+	}
+	return items, nil
+}
+
+// words of a STRING (length first) or STRINGZ (zero terminated) operand.
+// The text goes between apostrophes, a doubled apostrophe stands for one.
+func stringWords(instruction, operand string) ([]shared.Word, error) {
+	runes := []rune(operand)
+	if len(runes) < 2 || runes[0] != '\'' || runes[len(runes)-1] != '\'' {
+		return nil, errors.New(
+			"texto da pseudo instrução " + instruction + " deve estar entre apóstrofos")
+	}
+
+	var characters []shared.Word
+	for i := 1; i < len(runes)-1; i++ {
+		if runes[i] == '\'' {
+			if runes[i+1] != '\'' || i+1 == len(runes)-1 {
+				return nil, errors.New("apóstrofo sem par em " + operand)
+			}
+			i++
+		}
+		characters = append(characters, shared.Word(runes[i]))
+	}
+
+	if instruction == "STRINGZ" {
+		return append(characters, 0), nil
+	}
+	return append([]shared.Word{shared.Word(len(characters))}, characters...), nil
+}
+
+// words reserved by SPACE, one if there is no operand
+func (assembler *Assembler) spaceSize(operand string) (uint16, error) {
+	if operand == EMPTY {
+		return 1, nil
+	}
+
+	value, err := assembler.evaluateExpression(operand)
+	if err != nil {
+		return 0, err
+	}
+	if !value.isAbsolute() || value.value < 1 {
+		return 0, errors.New("tamanho da pseudo instrução space deve ser um valor absoluto positivo")
+	}
+	return uint16(value.value), nil
+}
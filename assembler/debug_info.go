@@ -0,0 +1,49 @@
+package assembler
+
+import (
+	"fmt"
+	"io"
+	"saturn/mp"
+	"saturn/shared"
+	"strings"
+)
+
+// where the words of an object line came from, kept in the module so the
+// linker can map image addresses back to the source
+type debugLine struct {
+	address uint16
+	origin  mp.Origin
+}
+
+func (assembler *Assembler) recordDebugLine() {
+	assembler.debugLines = append(assembler.debugLines,
+		debugLine{address: assembler.locationCounter, origin: assembler.origin()})
+}
+
+// the debug lines at module addresses, one per object line
+func (assembler *Assembler) sourceLines() []shared.SourceLocation {
+	var locations []shared.SourceLocation
+	for _, line := range assembler.debugLines {
+		locations = append(locations, shared.SourceLocation{
+			Address: line.address,
+			Module:  assembler.programName,
+			File:    line.origin.File,
+			Line:    int(line.origin.Line),
+			Macros:  line.origin.Macros,
+		})
+	}
+	return locations
+}
+
+// one "ADDRESS\tFILE\tLINE\tMACROS" line per object line, with the macros
+// being expanded joined by ">". Tabs allow spaces in file names.
+func writeDebugInfo(dbgFile io.Writer, lines []shared.SourceLocation) error {
+	for _, line := range lines {
+		_, err := fmt.Fprintf(dbgFile, "%d\t%s\t%d\t%s\n", line.Address,
+			line.File, line.Line, strings.Join(line.Macros, ">"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
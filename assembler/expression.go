@@ -0,0 +1,203 @@
+package assembler
+
+import (
+	"errors"
+	"math"
+	"saturn/parser"
+	"saturn/shared"
+	"strings"
+	"unicode"
+)
+
+// result of an operand expression. An expression may refer to at most one
+// INTUSE symbol, in which case value is the offset the linker adds to the
+// symbol's address and mode is always absolute.
+type expressionValue struct {
+	value    int
+	mode     byte
+	external string
+}
+
+func (v expressionValue) isAbsolute() bool {
+	return v.mode == shared.ABSOLUTE && v.external == EMPTY
+}
+
+// the assembler's values for parser.Arithmetic, which reads the whole
+// expression. Parentheses hold another sum.
+type expressionValues struct {
+	assembler  *Assembler
+	arithmetic *parser.Arithmetic[expressionValue]
+}
+
+// evaluates expression (without address mode markers) using the symbols
+// known so far. Relocation follows the usual rules: relative ± absolute is
+// relative, relative - relative is absolute, and anything else involving a
+// relative or external value is an error.
+func (assembler *Assembler) evaluateExpression(expression string) (expressionValue, error) {
+	values := &expressionValues{assembler: assembler}
+	arithmetic, err := parser.NewArithmetic[expressionValue](expression, values)
+	if err != nil {
+		return expressionValue{}, err
+	}
+	values.arithmetic = arithmetic
+
+	result, err := arithmetic.Sum()
+	if err != nil {
+		return expressionValue{}, err
+	}
+	if err := arithmetic.End(); err != nil {
+		return expressionValue{}, err
+	}
+	if result.value < math.MinInt16 || result.value > math.MaxInt16 {
+		return expressionValue{}, errors.New("valor da expressão " +
+			expression + " não cabe em uma palavra")
+	}
+
+	return result, nil
+}
+
+func (values *expressionValues) Operand(token string) (expressionValue, error) {
+	switch {
+	case validateSymbol(token) == nil:
+		return values.assembler.symbolValue(token)
+
+	case unicode.IsLetter([]rune(token)[0]) && !strings.HasPrefix(token, "H'"):
+		// a name, but not a valid symbol
+		return expressionValue{}, validateSymbol(token)
+
+	default:
+		value, err := getOperandValue(token)
+		if err != nil {
+			return expressionValue{}, err
+		}
+		return expressionValue{value: int(value), mode: shared.ABSOLUTE}, nil
+	}
+}
+
+func (values *expressionValues) Group() (expressionValue, error) {
+	return values.arithmetic.Sum()
+}
+
+func (values *expressionValues) Negate(value expressionValue) (expressionValue, error) {
+	if !value.isAbsolute() {
+		return value, errors.New("só valores absolutos podem ser negados")
+	}
+	value.value = -value.value
+	return value, nil
+}
+
+func (values *expressionValues) Add(left, right expressionValue) (expressionValue, error) {
+	return add(left, right)
+}
+
+func (values *expressionValues) Subtract(left, right expressionValue) (expressionValue, error) {
+	return subtract(left, right)
+}
+
+func (values *expressionValues) Multiply(left, right expressionValue) (expressionValue, error) {
+	if !left.isAbsolute() || !right.isAbsolute() {
+		return left, errors.New(
+			"multiplicação e divisão só são permitidas entre valores absolutos")
+	}
+	left.value *= right.value
+	return left, nil
+}
+
+func (values *expressionValues) Divide(left, right expressionValue) (expressionValue, error) {
+	if !left.isAbsolute() || !right.isAbsolute() {
+		return left, errors.New(
+			"multiplicação e divisão só são permitidas entre valores absolutos")
+	}
+	if right.value == 0 {
+		return left, errors.New("divisão por zero em expressão")
+	}
+	left.value /= right.value
+	return left, nil
+}
+
+func add(left, right expressionValue) (expressionValue, error) {
+	if left.external != EMPTY && right.external != EMPTY {
+		return left, errors.New("expressão com mais de um símbolo externo")
+	}
+	if left.external != EMPTY || right.external != EMPTY {
+		if left.mode == shared.RELATIVE || right.mode == shared.RELATIVE {
+			return left, errors.New(
+				"símbolo externo somado a valor relocável")
+		}
+		external := left.external + right.external
+		return expressionValue{
+			value:    left.value + right.value,
+			mode:     shared.ABSOLUTE,
+			external: external}, nil
+	}
+	if left.mode == shared.RELATIVE && right.mode == shared.RELATIVE {
+		return left, errors.New("soma de dois valores relocáveis")
+	}
+
+	mode := byte(shared.ABSOLUTE)
+	if left.mode == shared.RELATIVE || right.mode == shared.RELATIVE {
+		mode = shared.RELATIVE
+	}
+	return expressionValue{value: left.value + right.value, mode: mode}, nil
+}
+
+func subtract(left, right expressionValue) (expressionValue, error) {
+	if right.external != EMPTY {
+		return left, errors.New("símbolo externo não pode ser subtraído")
+	}
+	if left.external != EMPTY {
+		if right.mode == shared.RELATIVE {
+			return left, errors.New(
+				"valor relocável subtraído de símbolo externo")
+		}
+		left.value -= right.value
+		return left, nil
+	}
+	if left.mode == shared.ABSOLUTE && right.mode == shared.RELATIVE {
+		return left, errors.New("valor relocável subtraído de valor absoluto")
+	}
+
+	// relative - relative is a distance, so it is absolute
+	mode := byte(shared.ABSOLUTE)
+	if left.mode == shared.RELATIVE && right.mode == shared.ABSOLUTE {
+		mode = shared.RELATIVE
+	}
+	return expressionValue{value: left.value - right.value, mode: mode}, nil
+}
+
+// looks symbol up in the same order as the second pass always did.
+// Addresses are stored as uint16 but read back as words, so absolute
+// values may be negative.
+func (assembler *Assembler) symbolValue(symbol string) (expressionValue, error) {
+	assembler.recordReference(symbol)
+	if info, ok := assembler.symbolTable[symbol]; ok {
+		return expressionValue{
+			value: int(shared.Word(info.Address)), mode: info.Mode}, nil
+	}
+	if _, ok := assembler.useTable[symbol]; ok {
+		return expressionValue{mode: shared.ABSOLUTE, external: symbol}, nil
+	}
+	if info, ok := assembler.definitionTable[symbol]; ok {
+		return expressionValue{
+			value: int(shared.Word(info.Address)), mode: info.Mode}, nil
+	}
+
+	return expressionValue{}, &undefinedSymbolError{symbol}
+}
+
+type undefinedSymbolError struct {
+	symbol string
+}
+
+func (err *undefinedSymbolError) Error() string {
+	return "símbolo " + err.symbol + " não definido"
+}
+
+// an expression is either wrong in itself or refers to a missing symbol
+func expressionErrorCode(err error) string {
+	var undefined *undefinedSymbolError
+	if errors.As(err, &undefined) {
+		return shared.CodeUndefinedSymbol
+	}
+	return shared.CodeOperand
+}
@@ -0,0 +1,101 @@
+package assembler
+
+import (
+	"fmt"
+	"io"
+	"saturn/mp"
+	"strings"
+)
+
+// the listing shows every source line next to the words generated for it.
+// Lines produced by macro expansions follow the line that called the macro
+// and are marked with a "+". Lines of included files follow the INCLUDE and
+// are marked with a "=", their numbers are lines of the included file.
+
+const listingFormat = "%-4s %-16s %5s%1s %s\n"
+
+func (assembler *Assembler) writeListingHeader(lstFile io.Writer) {
+	assembler.writeListing(lstFile, "LOC", "CÓDIGO", "LINHA", "", "FONTE")
+}
+
+// lists words at the current address for the current line. The first words
+// go next to the line's text, more words (DATA, STRING, SPACE n) get lines
+// of their own.
+func (assembler *Assembler) listWords(lstFile io.Writer, words string) {
+	location := fmt.Sprintf("%02d", assembler.locationCounter)
+	if assembler.listedLine == assembler.lineCounter {
+		assembler.writeListing(lstFile, location, words, "", "", "")
+		return
+	}
+	assembler.listLine(lstFile, location, words)
+}
+
+// lists the current line if it generated nothing
+func (assembler *Assembler) listRemainingLine(lstFile io.Writer) {
+	if assembler.listedLine != assembler.lineCounter {
+		assembler.listLine(lstFile, "", "")
+	}
+}
+
+func (assembler *Assembler) listLine(lstFile io.Writer, location, words string) {
+	origin := assembler.origin()
+	line := origin.Line
+	marker := ""
+	text := assembler.currentLine
+	switch {
+	case assembler.isExpansion():
+		// the call is listed before its expansion
+		assembler.listSourceUntil(lstFile, assembler.mainLine(origin))
+		marker = "+"
+	case len(origin.Includes) != 0:
+		assembler.listSourceUntil(lstFile, assembler.mainLine(origin))
+		marker = "="
+		if source := assembler.sourceOf(origin.File); int(line) <= len(source) {
+			text = source[line-1]
+		}
+	default:
+		assembler.listSourceUntil(lstFile, line-1)
+		if int(line) <= len(assembler.source) && assembler.origins != nil {
+			text = assembler.source[line-1]
+		}
+		assembler.listedSource = line
+	}
+
+	assembler.writeListing(lstFile, location, words, fmt.Sprint(line), marker, text)
+	assembler.listedLine = assembler.lineCounter
+}
+
+// lists the source lines up to line that were not listed yet, such as
+// comments and macro definitions
+func (assembler *Assembler) listSourceUntil(lstFile io.Writer, line uint16) {
+	if assembler.origins == nil {
+		return
+	}
+	for assembler.listedSource < line && int(assembler.listedSource) < len(assembler.source) {
+		assembler.listedSource++
+		assembler.writeListing(lstFile, "", "", fmt.Sprint(assembler.listedSource), "",
+			assembler.source[assembler.listedSource-1])
+	}
+}
+
+// line of the file being assembled that led to origin, through includes
+// and macro calls
+func (assembler *Assembler) mainLine(origin mp.Origin) uint16 {
+	if len(origin.Includes) != 0 {
+		return origin.Includes[0].Line
+	}
+	return origin.Line
+}
+
+func (assembler *Assembler) isExpansion() bool {
+	idx := int(assembler.lineCounter) - 1
+	return idx >= 0 && idx < len(assembler.origins) && len(assembler.origins[idx].Macros) != 0
+}
+
+func (assembler *Assembler) writeListing(lstFile io.Writer, location, words, line, marker, text string) {
+	listingLine := fmt.Sprintf(listingFormat, location, words, line, marker, text)
+	_, err := io.WriteString(lstFile, strings.TrimRight(listingLine, " \n")+"\n")
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,181 @@
+package assembler
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"saturn/mp"
+	"saturn/shared"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// a source to assemble. Name is used in diagnostics and to find the files
+// the source includes.
+type Source struct {
+	Name   string
+	Reader io.Reader
+}
+
+// an assembled source, with what the linker needs and the text of the files
+// written for it
+type Module struct {
+	Name            string                  // given by START
+	Expanded        string                  // the source after the macro processor, as in MASMAPRG_NAME.ASM
+	Object          string                  // as in the .obj file
+	Listing         string                  // as in the .lst file
+	Lines           []shared.SourceLocation // where each object line came from, as in the .dbg file
+	DefinitionTable map[string]shared.SymbolInfo
+	UseTable        map[string][]uint16
+	SymbolTable     map[string]shared.SymbolInfo
+	Size            uint16
+	StackSize       uint16
+	Start           int // module address where execution starts, -1 if it has none
+}
+
+// Assemble runs the macro processor and the assembler over sources in
+// memory, nothing is written to the build directory. Problems in the sources
+// are returned as diagnostics, so every source is assembled even if one has
+// errors. Sources are assembled in parallel, one per processor.
+func Assemble(options mp.Options, sources ...Source) ([]Module, []shared.Diagnostic) {
+	return AssembleWithWorkers(options, runtime.GOMAXPROCS(0), sources...)
+}
+
+// Assemble with at most workers sources assembled at the same time. Modules
+// and diagnostics come in the order of sources whatever the number of
+// workers.
+func AssembleWithWorkers(options mp.Options, workers int, sources ...Source) (
+	modules []Module, diagnostics []shared.Diagnostic) {
+
+	type result struct {
+		module      Module
+		diagnostics []shared.Diagnostic
+		ok          bool // false if the source could not be read
+	}
+	results := make([]result, len(sources))
+
+	next := make(chan int)
+	var wait sync.WaitGroup
+	for worker := 0; worker < min(max(workers, 1), len(sources)); worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := range next {
+				module, moduleDiagnostics, ok := assembleSource(options, sources[i])
+				results[i] = result{module, moduleDiagnostics, ok}
+			}
+		}()
+	}
+	for i := range sources {
+		next <- i
+	}
+	close(next)
+	wait.Wait()
+
+	hasStart := false
+	for _, result := range results {
+		diagnostics = append(diagnostics, result.diagnostics...)
+		if result.ok {
+			modules = append(modules, result.module)
+			hasStart = hasStart || result.module.Start != -1
+		}
+	}
+
+	if !hasStart {
+		diagnostics = append(diagnostics, shared.Diagnostic{
+			Severity: shared.Error,
+			Code:     shared.CodeProgram,
+			Message:  "faltando indicação de onde começar a execução"})
+	}
+	return modules, diagnostics
+}
+
+// ok is false if source could not be read
+func assembleSource(options mp.Options, source Source) (Module, []shared.Diagnostic, bool) {
+	text, err := io.ReadAll(source.Reader)
+	if err != nil {
+		return Module{}, []shared.Diagnostic{{
+			File: source.Name, Severity: shared.Error,
+			Code: shared.CodeIO, Message: err.Error()}}, false
+	}
+	module, diagnostics := assemble(options, source.Name, text)
+	return module, diagnostics, true
+}
+
+func assemble(options mp.Options, fileName string, text []byte) (Module, []shared.Diagnostic) {
+	assembler := New()
+	assembler.filePath = fileName
+	assembler.source = strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+	macroProcessor := mp.NewWithOptions(options)
+
+	expanded := macroProcessor.Expand(fileName, bytes.NewReader(text))
+	assembler.origins = macroProcessor.Origins()
+	assembler.includedSources = macroProcessor.Sources()
+	// listed along with the assembler's own
+	assembler.diagnostics = slices.Clone(macroProcessor.Diagnostics())
+
+	masmaprg := strings.NewReader(expanded)
+	stackSize := assembler.firstPass(masmaprg)
+	definitionTable, useTable, programName, programSize := assembler.secondPass(masmaprg)
+
+	return Module{
+		Name:            programName,
+		Expanded:        expanded,
+		Object:          assembler.object.String(),
+		Listing:         assembler.listing.String(),
+		Lines:           assembler.sourceLines(),
+		DefinitionTable: definitionTable,
+		UseTable:        useTable,
+		SymbolTable:     assembler.symbolTable,
+		Size:            programSize,
+		StackSize:       stackSize,
+		Start:           assembler.programStart,
+	}, assembler.diagnostics
+}
+
+// reads the files in paths into memory. Files that can't be read are
+// reported and left out.
+func ReadSources(paths ...string) (sources []Source, diagnostics []shared.Diagnostic) {
+	for _, path := range paths {
+		text, err := os.ReadFile(path)
+		if err != nil {
+			diagnostics = append(diagnostics, shared.Diagnostic{
+				File: path, Severity: shared.Error,
+				Code: shared.CodeIO, Message: err.Error()})
+			continue
+		}
+		sources = append(sources, Source{Name: path, Reader: bytes.NewReader(text)})
+	}
+	return sources, diagnostics
+}
+
+// writes the module's expanded source (MASMAPRG_NAME.ASM), .obj, .lst and
+// .dbg files to directory, usually shared.BuildDirectory
+func (module Module) WriteFiles(directory string) error {
+	files := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"MASMAPRG_" + module.Name + ".ASM", writeString(module.Expanded)},
+		{module.Name + ".obj", writeString(module.Object)},
+		{module.Name + ".lst", writeString(module.Listing)},
+		{module.Name + ".dbg", func(file io.Writer) error {
+			return writeDebugInfo(file, module.Lines)
+		}},
+	}
+	for _, file := range files {
+		if err := shared.WriteBuildFile(directory, file.name, file.write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeString(text string) func(io.Writer) error {
+	return func(file io.Writer) error {
+		_, err := io.WriteString(file, text)
+		return err
+	}
+}
@@ -9,6 +9,22 @@ var pseudoOpSizes map[string]uint16 = map[string]uint16{
 	"CONST":  1,
 	"SPACE":  1,
 	"STACK":  1,
+	"EQU":    0,
+	"SET":    0,
+	// skip a number of words that depends on the operand, see gapSize
+	"ORG":     0,
+	"ALIGN":   0,
+	"RESERVE": 0,
+	// one word per item or character, sized in the first pass
+	"DATA":    0,
+	"STRING":  0,
+	"STRINGZ": 0,
+}
+
+// reports whether token is a pseudo instruction handled by the assembler
+func IsPseudoInstruction(token string) bool {
+	_, ok := pseudoOpSizes[token]
+	return ok
 }
 
 /*
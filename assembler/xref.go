@@ -0,0 +1,139 @@
+package assembler
+
+import (
+	"fmt"
+	"io"
+	"saturn/shared"
+	"sort"
+	"strings"
+)
+
+// where a symbol is defined and the source lines that refer to it. Lines
+// of included files are listed under their INCLUDE, so the table refers to
+// the listing by the line of the file being assembled.
+type symbolUsage struct {
+	kind        string
+	file        string
+	line        uint16 // of file
+	listingLine uint16
+	references  map[uint16]bool // listing lines
+}
+
+// labels of these pseudo instructions are listed with the pseudo instruction
+// as their kind, other labels are local
+var symbolKinds = map[string]bool{
+	"CONST": true, "SPACE": true, "EQU": true, "SET": true, "DATA": true,
+	"STRING": true, "STRINGZ": true, "RESERVE": true, "INTUSE": true,
+}
+
+func symbolKind(operation string) string {
+	if symbolKinds[operation] {
+		return operation
+	}
+	return "local"
+}
+
+// only the first definition counts, later ones are errors or SET updates
+func (assembler *Assembler) recordDefinition(symbol, kind string) {
+	if validateSymbol(symbol) != nil {
+		return
+	}
+	if usage, ok := assembler.usages[symbol]; ok {
+		if usage.line == 0 {
+			usage.kind = kind
+			usage.file = assembler.origin().File
+			usage.line = assembler.sourceLine()
+			usage.listingLine = assembler.mainLine(assembler.origin())
+		}
+		return
+	}
+	assembler.usages[symbol] = &symbolUsage{kind: kind, file: assembler.origin().File,
+		line: assembler.sourceLine(), listingLine: assembler.mainLine(assembler.origin()),
+		references: map[uint16]bool{}}
+}
+
+// both passes evaluate some operands, so a line is recorded only once
+func (assembler *Assembler) recordReference(symbol string) {
+	usage, ok := assembler.usages[symbol]
+	if !ok {
+		usage = &symbolUsage{references: map[uint16]bool{}}
+		assembler.usages[symbol] = usage
+	}
+	usage.references[assembler.mainLine(assembler.origin())] = true
+}
+
+func (assembler *Assembler) sortedSymbols() []string {
+	var symbols []string
+	for symbol, usage := range assembler.usages {
+		if usage.line != 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// exported symbols are used by other modules and the entry point by the
+// machine, everything else should be referenced somewhere. Included files
+// hold definitions for many programs, so their symbols are not reported.
+func (assembler *Assembler) warnUnusedSymbols() {
+	for _, symbol := range assembler.sortedSymbols() {
+		usage := assembler.usages[symbol]
+		_, isGlobal := assembler.definitionTable[symbol]
+		if len(usage.references) != 0 || isGlobal || symbol == assembler.programName ||
+			usage.file != assembler.filePath {
+			continue
+		}
+
+		text, _ := assembler.sourceText(usage.file, usage.line)
+		message := "símbolo " + symbol + " definido mas não usado"
+		if usage.kind == "INTUSE" {
+			message = "símbolo externo " + symbol + " declarado mas não usado"
+		}
+		assembler.diagnostics = append(assembler.diagnostics, shared.Diagnostic{
+			File:     assembler.filePath,
+			Line:     int(usage.line),
+			Column:   assembler.column(text, symbol),
+			Severity: shared.Warning,
+			Code:     shared.CodeUnusedSymbol,
+			Message:  message})
+	}
+}
+
+func (assembler *Assembler) writeCrossReference(lstFile io.Writer) {
+	var section strings.Builder
+	section.WriteString("\nTabela de símbolos\n")
+	fmt.Fprintf(&section, "%-8s %6s %4s %-7s %4s  %s\n",
+		"SÍMBOLO", "VALOR", "MODO", "TIPO", "DEF", "REFERÊNCIAS")
+
+	for _, symbol := range assembler.sortedSymbols() {
+		usage := assembler.usages[symbol]
+
+		value, mode := "--", "-"
+		if info, ok := assembler.symbolTable[symbol]; ok {
+			value, mode = fmt.Sprintf("%02d", shared.Word(info.Address)), string(info.Mode)
+		} else if info, ok := assembler.definitionTable[symbol]; ok {
+			value, mode = fmt.Sprintf("%02d", shared.Word(info.Address)), string(info.Mode)
+		}
+
+		kind := usage.kind
+		if _, isGlobal := assembler.definitionTable[symbol]; isGlobal {
+			kind = "INTDEF"
+		}
+
+		var lines []int
+		for line := range usage.references {
+			lines = append(lines, int(line))
+		}
+		sort.Ints(lines)
+		references := strings.Trim(fmt.Sprint(lines), "[]")
+
+		fmt.Fprintf(&section, "%-8s %6s %4s %-7s %4d  %s\n",
+			symbol, value, mode, kind, usage.listingLine, references)
+	}
+	section.WriteString("\n")
+
+	if _, err := io.WriteString(lstFile, section.String()); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,226 @@
+package gui
+
+import (
+	"math"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// a multi-line editor whose text is highlighted while it is edited. Fyne's
+// Entry cannot style parts of its text, so this is a TextGrid that takes
+// taps and keys itself, with a block cursor and no selection.
+type codeEntry struct {
+	widget.TextGrid
+	lines      [][]rune
+	row, col   int // of the cursor, col may be len(lines[row])
+	focused    bool
+	errorLines map[int]bool      // 1 based, marked as in highlight
+	scroll     *container.Scroll // kept on the cursor, if set
+	OnChanged  func(text string)
+}
+
+func newCodeEntry(text string) *codeEntry {
+	entry := &codeEntry{errorLines: map[int]bool{}}
+	entry.ExtendBaseWidget(entry)
+	entry.setText(text)
+	return entry
+}
+
+func (entry *codeEntry) Text() string {
+	lines := make([]string, len(entry.lines))
+	for i, line := range entry.lines {
+		lines[i] = string(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// replaces the text and puts the cursor at its start
+func (entry *codeEntry) setText(text string) {
+	entry.lines = nil
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		entry.lines = append(entry.lines, []rune(line))
+	}
+	entry.row, entry.col = 0, 0
+	entry.refresh()
+}
+
+// highlights the text again and draws the cursor over it
+func (entry *codeEntry) refresh() {
+	highlight(&entry.TextGrid, entry.Text(), entry.errorLines)
+	if !entry.focused {
+		return
+	}
+
+	cursor := &widget.CustomTextGridStyle{BGColor: theme.Color(theme.ColorNamePrimary)}
+	row := entry.TextGrid.Rows[entry.row]
+	if entry.col < len(row.Cells) && row.Cells[entry.col].Style != nil {
+		cursor.FGColor = row.Cells[entry.col].Style.TextColor()
+	}
+	entry.TextGrid.SetStyle(entry.row, entry.col, cursor)
+}
+
+func (entry *codeEntry) changed() {
+	entry.refresh()
+	entry.showCursor()
+	if entry.OnChanged != nil {
+		entry.OnChanged(entry.Text())
+	}
+}
+
+func (entry *codeEntry) moved() {
+	entry.refresh()
+	entry.showCursor()
+}
+
+// the size of a character, as TextGrid measures it
+func (entry *codeEntry) cellSize() fyne.Size {
+	size := fyne.MeasureText("M", entry.Theme().Size(theme.SizeNameText),
+		fyne.TextStyle{Monospace: true})
+	return fyne.NewSize(float32(math.Round(float64(size.Width))),
+		float32(math.Round(float64(size.Height))))
+}
+
+// scrolls just enough to show the cursor
+func (entry *codeEntry) showCursor() {
+	if entry.scroll == nil {
+		return
+	}
+	// the text may have grown, the offset is only kept within its new size
+	// once the scroll lays it out again
+	entry.scroll.Refresh()
+
+	cell := entry.cellSize()
+	// the entry may sit beside other content of the scroll
+	position := entry.Position()
+	x := position.X + float32(entry.col)*cell.Width
+	y := position.Y + float32(entry.row)*cell.Height
+	view, offset := entry.scroll.Size(), entry.scroll.Offset
+	offset.X = fyne.Min(fyne.Max(offset.X, x+cell.Width-view.Width), x)
+	offset.Y = fyne.Min(fyne.Max(offset.Y, y+cell.Height-view.Height), y)
+	if offset != entry.scroll.Offset {
+		entry.scroll.Offset = offset
+		entry.scroll.Refresh()
+	}
+}
+
+// inserts text at the cursor, which ends up after it
+func (entry *codeEntry) insert(text string) {
+	inserted := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	line := entry.lines[entry.row]
+	before, after := string(line[:entry.col]), string(line[entry.col:])
+
+	var lines [][]rune
+	for _, part := range inserted {
+		lines = append(lines, []rune(part))
+	}
+	last := len(lines) - 1
+	entry.col = len(lines[last])
+	lines[0] = []rune(before + string(lines[0]))
+	if last == 0 {
+		entry.col += len([]rune(before))
+	}
+	lines[last] = []rune(string(lines[last]) + after)
+
+	entry.lines = append(entry.lines[:entry.row],
+		append(lines, entry.lines[entry.row+1:]...)...)
+	entry.row += last
+	entry.changed()
+}
+
+func (entry *codeEntry) Tapped(event *fyne.PointEvent) {
+	if canvas := fyne.CurrentApp().Driver().CanvasForObject(entry); canvas != nil {
+		canvas.Focus(entry)
+	}
+
+	cell := entry.cellSize()
+	entry.row = min(max(int(event.Position.Y/cell.Height), 0), len(entry.lines)-1)
+	entry.col = min(max(int(event.Position.X/cell.Width+0.5), 0), len(entry.lines[entry.row]))
+	entry.moved()
+}
+
+func (entry *codeEntry) Cursor() desktop.Cursor {
+	return desktop.TextCursor
+}
+
+func (entry *codeEntry) FocusGained() {
+	entry.focused = true
+	entry.refresh()
+}
+
+func (entry *codeEntry) FocusLost() {
+	entry.focused = false
+	entry.refresh()
+}
+
+func (entry *codeEntry) TypedRune(r rune) {
+	entry.insert(string(r))
+}
+
+func (entry *codeEntry) TypedKey(event *fyne.KeyEvent) {
+	line := entry.lines[entry.row]
+	switch event.Name {
+	case fyne.KeyReturn, fyne.KeyEnter:
+		entry.insert("\n")
+		return
+
+	case fyne.KeyBackspace:
+		if entry.col > 0 {
+			entry.col--
+			entry.lines[entry.row] = append(line[:entry.col:entry.col], line[entry.col+1:]...)
+		} else if entry.row > 0 {
+			entry.row--
+			entry.col = len(entry.lines[entry.row])
+			entry.lines[entry.row] = append(entry.lines[entry.row], line...)
+			entry.lines = append(entry.lines[:entry.row+1], entry.lines[entry.row+2:]...)
+		}
+		entry.changed()
+		return
+
+	case fyne.KeyDelete:
+		if entry.col < len(line) {
+			entry.lines[entry.row] = append(line[:entry.col:entry.col], line[entry.col+1:]...)
+		} else if entry.row+1 < len(entry.lines) {
+			entry.lines[entry.row] = append(line, entry.lines[entry.row+1]...)
+			entry.lines = append(entry.lines[:entry.row+1], entry.lines[entry.row+2:]...)
+		}
+		entry.changed()
+		return
+
+	case fyne.KeyLeft:
+		if entry.col > 0 {
+			entry.col--
+		} else if entry.row > 0 {
+			entry.row--
+			entry.col = len(entry.lines[entry.row])
+		}
+	case fyne.KeyRight:
+		if entry.col < len(line) {
+			entry.col++
+		} else if entry.row+1 < len(entry.lines) {
+			entry.row, entry.col = entry.row+1, 0
+		}
+	case fyne.KeyUp:
+		entry.row = max(entry.row-1, 0)
+	case fyne.KeyDown:
+		entry.row = min(entry.row+1, len(entry.lines)-1)
+	case fyne.KeyHome:
+		entry.col = 0
+	case fyne.KeyEnd:
+		entry.col = len(line)
+	default:
+		return
+	}
+	entry.col = min(entry.col, len(entry.lines[entry.row]))
+	entry.moved()
+}
+
+func (entry *codeEntry) TypedShortcut(shortcut fyne.Shortcut) {
+	if paste, ok := shortcut.(*fyne.ShortcutPaste); ok {
+		entry.insert(paste.Clipboard.Content())
+	}
+}
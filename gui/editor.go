@@ -0,0 +1,141 @@
+package gui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"saturn/shared"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// the text is edited and highlighted in entry, with its line numbers in a
+// column beside it
+type sourceEditor struct {
+	path        string
+	entry       *codeEntry
+	lineNumbers *widget.TextGrid
+	tab         *container.TabItem
+}
+
+var editors []*sourceEditor
+var editorTabs = container.NewDocTabs()
+
+func findEditor(path string) *sourceEditor {
+	for _, sourceEditor := range editors {
+		if sourceEditor.path == path {
+			return sourceEditor
+		}
+	}
+	return nil
+}
+
+// opens path in a new tab, or selects its tab if already open
+func openEditor(path string) {
+	if sourceEditor := findEditor(path); sourceEditor != nil {
+		editorTabs.Select(sourceEditor.tab)
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		errorsList.Add(widget.NewLabel(err.Error()))
+		return
+	}
+
+	sourceEditor := &sourceEditor{
+		path:        path,
+		entry:       newCodeEntry(string(content)),
+		lineNumbers: widget.NewTextGrid(),
+	}
+	sourceEditor.entry.OnChanged = func(string) {
+		sourceEditor.numberLines()
+	}
+	sourceEditor.numberLines()
+
+	lines := container.NewBorder(nil, nil, sourceEditor.lineNumbers, nil, sourceEditor.entry)
+	sourceEditor.entry.scroll = container.NewScroll(lines)
+	sourceEditor.tab = container.NewTabItem(filepath.Base(path), sourceEditor.entry.scroll)
+
+	editors = append(editors, sourceEditor)
+	editorTabs.Append(sourceEditor.tab)
+	editorTabs.Select(sourceEditor.tab)
+}
+
+// one number per line of the entry, aligned to the right
+func (sourceEditor *sourceEditor) numberLines() {
+	count := len(sourceEditor.entry.lines)
+	if len(sourceEditor.lineNumbers.Rows) == count {
+		return
+	}
+	width := len(strconv.Itoa(count))
+	numbers := make([]string, count)
+	for i := range numbers {
+		numbers[i] = fmt.Sprintf("%*d ", width, i+1)
+	}
+	sourceEditor.lineNumbers.SetText(strings.Join(numbers, "\n"))
+	for row := range numbers {
+		sourceEditor.lineNumbers.SetRowStyle(row, widget.TextGridStyleWhitespace)
+	}
+}
+
+func saveEditors() error {
+	for _, sourceEditor := range editors {
+		err := os.WriteFile(sourceEditor.path, []byte(sourceEditor.entry.Text()), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaces the error marks of every open file, warnings are not marked
+func markErrors(diagnostics []shared.Diagnostic) {
+	for _, sourceEditor := range editors {
+		sourceEditor.entry.errorLines = map[int]bool{}
+	}
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity != shared.Error {
+			continue
+		}
+		if sourceEditor := findEditor(diagnostic.File); sourceEditor != nil {
+			sourceEditor.entry.errorLines[diagnostic.Line] = true
+		}
+	}
+	for _, sourceEditor := range editors {
+		sourceEditor.entry.refresh()
+	}
+}
+
+func editor() fyne.CanvasObject {
+	saveBtn := widget.NewButton("Salvar", func() {
+		if err := saveEditors(); err != nil {
+			dialog.ShowError(err, window)
+		}
+	})
+
+	assembleBtn := widget.NewButton("Montar e Carregar", func() {
+		if err := saveEditors(); err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		Assemble(sources...)
+	})
+
+	editorTabs.OnClosed = func(tab *container.TabItem) {
+		for i, sourceEditor := range editors {
+			if sourceEditor.tab == tab {
+				editors = append(editors[:i], editors[i+1:]...)
+				return
+			}
+		}
+	}
+
+	toolbar := container.NewHBox(saveBtn, assembleBtn)
+	return container.NewBorder(toolbar, nil, nil, nil, editorTabs)
+}
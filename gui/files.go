@@ -0,0 +1,133 @@
+package gui
+
+import (
+	"fmt"
+	"path/filepath"
+	"saturn/linker"
+	"saturn/mp"
+	"saturn/pipeline"
+	"saturn/shared"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+)
+
+var window fyne.Window
+var buildOptions mp.Options
+var sources []string
+var sourcesList = container.NewVBox()
+var errorsList = container.NewVBox()
+
+// runs the macro processor, assembler and linker over the given files and
+// loads the resulting image into a new machine. The previous program stays
+// loaded if anything goes wrong.
+func Assemble(paths ...string) {
+	sources = paths
+	updateSources()
+	for _, path := range paths {
+		openEditor(path)
+	}
+
+	errorsList.RemoveAll()
+	image, diagnostics := build(paths)
+	if !shared.HasErrors(diagnostics) {
+		previous := machine
+		Initialize(image.StackSize, image.Start)
+		if err := LoadProgram(image.Program); err != nil {
+			machine = previous
+			diagnostics = append(diagnostics, shared.Diagnostic{
+				Severity: shared.Error,
+				Code:     shared.CodeProgram,
+				Message:  fmt.Sprintf("%s não pode ser carregado: %v", image.Name, err)})
+		}
+	}
+
+	markErrors(diagnostics)
+	for _, diagnostic := range diagnostics {
+		errorsList.Add(widget.NewLabel(diagnostic.String()))
+	}
+	if shared.HasErrors(diagnostics) {
+		return
+	}
+
+	errorsList.Add(widget.NewLabel("Nenhum erro detectado."))
+	segments = image.Segments
+	loadSymbols(image.Symbols)
+	sourceMap = image.SourceMap
+	updateGUI()
+}
+
+// builds paths and writes the results to the build directory, as the
+// command line does. The image is nil if the program has errors.
+func build(paths []string) (*linker.Image, []shared.Diagnostic) {
+	if len(paths) == 0 {
+		return nil, []shared.Diagnostic{{
+			Severity: shared.Error,
+			Code:     shared.CodeProgram,
+			Message:  "nenhum arquivo selecionado"}}
+	}
+
+	result, diagnostics := pipeline.BuildFiles(buildOptions, paths...)
+	if err := result.WriteFiles(shared.BuildDirectory); err != nil {
+		diagnostics = append(diagnostics, shared.Diagnostic{
+			Severity: shared.Error,
+			Code:     shared.CodeIO,
+			Message:  err.Error()})
+	}
+	return result.Image, diagnostics
+}
+
+func updateSources() {
+	sourcesList.RemoveAll()
+	for _, path := range sources {
+		sourcesList.Add(widget.NewLabel(filepath.Base(path)))
+	}
+}
+
+func openSource() {
+	fileOpen := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		if reader == nil { // cancelled
+			return
+		}
+		defer reader.Close()
+
+		sources = append(sources, reader.URI().Path())
+		updateSources()
+		openEditor(reader.URI().Path())
+	}, window)
+	fileOpen.SetFilter(storage.NewExtensionFileFilter([]string{".asm", ".ASM"}))
+	fileOpen.Show()
+}
+
+func fileMenu() *fyne.Menu {
+	return fyne.NewMenu("Arquivo",
+		fyne.NewMenuItem("Abrir...", openSource),
+		fyne.NewMenuItem("Montar e Carregar", func() {
+			Assemble(sources...)
+		}),
+		fyne.NewMenuItem("Limpar Arquivos", func() {
+			sources = nil
+			updateSources()
+		}),
+	)
+}
+
+func files() *fyne.Container {
+	assembleBtn := widget.NewButton("Montar e Carregar", func() {
+		Assemble(sources...)
+	})
+
+	scrollableErrors := container.NewVScroll(errorsList)
+	scrollableErrors.SetMinSize(fyne.NewSize(300, 200))
+
+	return container.NewVBox(
+		widget.NewCard("Arquivos", "", container.NewVBox(sourcesList, assembleBtn)),
+		widget.NewCard("Erros", "", scrollableErrors))
+}
@@ -3,6 +3,7 @@ package gui
 import (
 	"fmt"
 	"image/color"
+	"saturn/mp"
 	"saturn/shared"
 	"saturn/vm"
 	"strconv"
@@ -11,6 +12,7 @@ import (
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
 )
@@ -21,34 +23,51 @@ var machine *vm.VirtualMachine
 var output *widget.Label
 var programBackup []shared.Word
 
-func Initialize(stackLimit uint16) {
-	machine = vm.New(stackLimit)
-	output = widget.NewLabel(strconv.Itoa((int(machine.Output()))))
+func Initialize(stackLimit, start uint16) {
+	machine = vm.New(stackLimit, start)
+	// the output card keeps this label, so it is only created once
+	if output == nil {
+		output = widget.NewLabel(strconv.Itoa((int(machine.Output()))))
+	}
 }
 
-func LoadProgram(program []shared.Word) {
+func LoadProgram(program []shared.Word) error {
+	if err := machine.LoadProgram(program); err != nil {
+		return err
+	}
 	programBackup = program
-	machine.LoadProgram(program)
+	syncMemorySnapshot()
+	return nil
 }
 
-func ReInsertProgram() {
-	machine.LoadProgram(programBackup)
+func ReInsertProgram() error {
+	return machine.LoadProgram(programBackup)
 }
 
-func Run() {
+// opens the window with the given source files assembled and loaded
+func Run(options mp.Options, paths ...string) {
+	buildOptions = options
 	a := app.New()
+	Initialize(0, 0)
 
-	//left := container.NewVBox(buttons())
-	middle := container.NewVBox(registers(), io(), buttons())
+	left := container.NewVBox(files(), symbolsPanel())
+	middle := container.NewVBox(registers(), io(), buttons(), stackPanel())
 	right := container.NewVBox(memory())
 
-	root := container.NewHBox(layout.NewSpacer(), layout.NewSpacer(),
+	root := container.NewHBox(left, layout.NewSpacer(),
 		middle, layout.NewSpacer(), right)
 
+	tabs := container.NewAppTabs(
+		container.NewTabItem("Máquina", root),
+		container.NewTabItem("Editor", editor()))
+
 	w := a.NewWindow("Saturn")
+	window = w
 	w.Resize(fyne.NewSize(1200, 700))
-	w.SetContent(root)
+	w.SetMainMenu(fyne.NewMainMenu(fileMenu()))
+	w.SetContent(tabs)
 
+	Assemble(paths...)
 	updateGUI()
 
 	w.ShowAndRun()
@@ -63,47 +82,35 @@ func updateGUI() {
 
 	r.RemoveAll()
 	r.Add(widget.NewLabel(fmt.Sprintf("Program Counter: %d", machine.PC())))
+	r.Add(widget.NewLabel("Fonte: " + sourceAt(machine.PC())))
 	r.Add(widget.NewLabel(fmt.Sprintf("Stack Pointer: %d", machine.SP())))
 	r.Add(widget.NewLabel(fmt.Sprintf("Acumulador: %d", machine.Accumulator())))
 	r.Add(widget.NewLabel(fmt.Sprintf("Operação: %d", machine.Operation())))
 	r.Add(widget.NewLabel(fmt.Sprintf("Endereço de Memória: %d", machine.MemoryAddress())))
 
-	mem.RemoveAll()
-	for i, value := range machine.Memory() {
-		textAddress := canvas.NewText(fmt.Sprintf("%03d", i), color.White)
-		textValue := canvas.NewText("["+fmt.Sprintf("%03d", value)+"]", color.RGBA{R: 255, B: 0, G: 255, A: 255})
-		cont := container.NewHBox(textAddress, textValue)
-
-		mem.Add(cont)
-	}
-}
-
-func memory() fyne.Widget {
-	scrollable := container.NewVScroll(mem)
-	scrollable.SetMinSize(fyne.NewSize(300, 700))
-
-	backgroundColor := color.RGBA{R: 0, B: 0, G: 0, A: 50}
-	background := canvas.NewRectangle(backgroundColor)
+	updateStack()
 
-	withBackground := container.NewStack(background, scrollable)
-	return widget.NewCard("Memória", "", withBackground)
+	updateMemory()
 }
 
 func buttons() *fyne.Container {
 	executeBtn := widget.NewButton("Executar", func() {
 		if machine.IsRunning() {
-			machine.Execute()
+			step()
 			updateGUI()
 		}
 	})
 
 	executeAllBtn := widget.NewButton("Executar Tudo", func() {
-		machine.ExecuteAll()
+		machine.Reset()
+		for machine.IsRunning() && step() {
+		}
 		updateGUI()
 	})
 
 	resetBtn := widget.NewButton("Resetar", func() {
 		machine.Reset()
+		syncMemorySnapshot()
 		updateGUI()
 	})
 
@@ -116,7 +123,8 @@ func io() *fyne.Container {
 	inputBtn := widget.NewButton("Salvar", func() {
 		data, err := strconv.Atoi(inputEntry.Text)
 		if err != nil {
-			panic(err)
+			dialog.ShowError(fmt.Errorf("entrada deve ser um número: %q", inputEntry.Text), window)
+			return
 		}
 		machine.SetInput(uint16(data))
 	})
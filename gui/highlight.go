@@ -0,0 +1,155 @@
+package gui
+
+import (
+	"image/color"
+	"saturn/assembler"
+	"saturn/mp"
+	"strings"
+	"unicode"
+
+	"fyne.io/fyne/v2/widget"
+)
+
+type tokenKind int
+
+const (
+	plainToken tokenKind = iota
+	labelToken
+	mnemonicToken
+	pseudoOpToken
+	macroToken
+	immediateToken
+	indirectToken
+	commentToken
+)
+
+// start and end are rune columns, end is exclusive
+type token struct {
+	start int
+	end   int
+	kind  tokenKind
+}
+
+var tokenStyles = map[tokenKind]widget.TextGridStyle{
+	labelToken:     &widget.CustomTextGridStyle{FGColor: color.RGBA{R: 255, G: 200, B: 80, A: 255}},
+	mnemonicToken:  &widget.CustomTextGridStyle{FGColor: color.RGBA{R: 100, G: 180, B: 255, A: 255}},
+	pseudoOpToken:  &widget.CustomTextGridStyle{FGColor: color.RGBA{R: 210, G: 120, B: 255, A: 255}},
+	macroToken:     &widget.CustomTextGridStyle{FGColor: color.RGBA{R: 80, G: 220, B: 200, A: 255}},
+	immediateToken: &widget.CustomTextGridStyle{FGColor: color.RGBA{R: 140, G: 230, B: 110, A: 255}},
+	indirectToken:  &widget.CustomTextGridStyle{FGColor: color.RGBA{R: 255, G: 140, B: 100, A: 255}},
+	commentToken:   &widget.CustomTextGridStyle{FGColor: color.RGBA{R: 130, G: 130, B: 130, A: 255}},
+}
+
+var errorLineStyle = &widget.CustomTextGridStyle{
+	BGColor: color.RGBA{R: 120, G: 0, B: 0, A: 120}}
+
+// the name of a macro is the operation of the first line after MACRO
+func macroNames(lines []string) map[string]bool {
+	names := map[string]bool{}
+	isDefinition := false
+	for _, line := range lines {
+		words := strings.Fields(line)
+		if len(words) == 0 || strings.HasPrefix(line, "*") {
+			continue
+		}
+
+		// the definition line may or may not have a label parameter
+		operation := words[0]
+		if len(words) > 1 && !unicode.IsSpace(rune(line[0])) {
+			operation = words[1]
+		}
+
+		if isDefinition {
+			names[operation] = true
+			isDefinition = false
+		}
+		if operation == "MACRO" {
+			isDefinition = true
+		}
+	}
+	return names
+}
+
+// follows the column rules of parser.Line: a label only exists if the line
+// doesn't start with a space, and anything after a word starting with '*'
+// is a comment
+func highlightLine(line string, macros map[string]bool) []token {
+	runes := []rune(line)
+	var tokens []token
+
+	if len(runes) > 0 && runes[0] == '*' {
+		return []token{{start: 0, end: len(runes), kind: commentToken}}
+	}
+
+	field := 1 // operation
+	if len(runes) > 0 && !unicode.IsSpace(runes[0]) {
+		field = 0 // label
+	}
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		if runes[i] == '*' {
+			tokens = append(tokens, token{start: start, end: len(runes), kind: commentToken})
+			break
+		}
+		quoted := false
+		for i < len(runes) && (quoted || !unicode.IsSpace(runes[i])) {
+			if runes[i] == '\'' {
+				quoted = !quoted
+			}
+			i++
+		}
+		word := string(runes[start:i])
+
+		kind := plainToken
+		switch {
+		case field == 0:
+			kind = labelToken
+		case field == 1:
+			if assembler.IsInstruction(word) {
+				kind = mnemonicToken
+			} else if assembler.IsPseudoInstruction(word) || mp.IsDirective(word) {
+				kind = pseudoOpToken
+			} else if macros[word] {
+				kind = macroToken
+			}
+		case strings.HasPrefix(word, "#"):
+			kind = immediateToken
+		case strings.HasSuffix(word, ",I"):
+			kind = indirectToken
+		}
+
+		tokens = append(tokens, token{start: start, end: i, kind: kind})
+		field++
+	}
+
+	return tokens
+}
+
+// writes text into grid, coloring tokens and marking errorLines (1 based)
+func highlight(grid *widget.TextGrid, text string, errorLines map[int]bool) {
+	grid.SetText(text)
+
+	lines := strings.Split(text, "\n")
+	macros := macroNames(lines)
+	for row, line := range lines {
+		if errorLines[row+1] {
+			grid.SetRowStyle(row, errorLineStyle)
+		}
+
+		for _, t := range highlightLine(line, macros) {
+			style, ok := tokenStyles[t.kind]
+			if !ok {
+				continue
+			}
+			for col := t.start; col < t.end; col++ {
+				grid.SetStyle(row, col, style)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package gui
+
+import (
+	"fmt"
+	"image/color"
+	"saturn/linker"
+	"saturn/shared"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/widget"
+)
+
+type region int
+
+const (
+	reservedRegion region = iota
+	stackRegion
+	textRegion
+	dataRegion
+	spaceRegion
+	freeRegion
+)
+
+var regionNames = map[region]string{
+	reservedRegion: "reservado",
+	stackRegion:    "pilha",
+	textRegion:     "texto",
+	dataRegion:     "dados",
+	spaceRegion:    "space",
+	freeRegion:     "livre",
+}
+
+var regionColors = map[region]color.RGBA{
+	reservedRegion: {R: 90, G: 90, B: 90, A: 120},
+	stackRegion:    {R: 200, G: 110, B: 0, A: 120},
+	textRegion:     {R: 0, G: 90, B: 200, A: 120},
+	dataRegion:     {R: 0, G: 150, B: 60, A: 120},
+	spaceRegion:    {R: 130, G: 60, B: 180, A: 120},
+	freeRegion:     {R: 0, G: 0, B: 0, A: 0},
+}
+
+var flashColor = color.RGBA{R: 255, G: 255, B: 0, A: 200}
+
+const flashDuration = time.Second
+
+// segment boundaries of the loaded program, set by the linker
+var segments linker.SegmentSizes
+
+// memory as of the last update, used to find recently written cells
+var previousMemory [128]shared.Word
+
+var hoverInfo = widget.NewLabel("")
+var memoryScroll = container.NewVScroll(mem)
+
+// a memory grid cell that describes its address while hovered
+type memoryCell struct {
+	widget.BaseWidget
+	address uint16
+	content fyne.CanvasObject
+}
+
+func newMemoryCell(address uint16, content fyne.CanvasObject) *memoryCell {
+	cell := &memoryCell{address: address, content: content}
+	cell.ExtendBaseWidget(cell)
+	return cell
+}
+
+func (cell *memoryCell) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(cell.content)
+}
+
+func (cell *memoryCell) MouseIn(*desktop.MouseEvent) {
+	hoverInfo.SetText(describeAddress(cell.address))
+}
+
+func (cell *memoryCell) MouseMoved(*desktop.MouseEvent) {}
+
+func (cell *memoryCell) MouseOut() {
+	hoverInfo.SetText("")
+}
+
+// the image is loaded as text, data then space right after the stack
+func regionOf(address uint16) region {
+	if address < machine.StackBase() {
+		return reservedRegion
+	}
+	if address < machine.ProgramBase() {
+		return stackRegion
+	}
+
+	offset := int(address - machine.ProgramBase())
+	switch {
+	case offset < segments.Text():
+		return textRegion
+	case offset < segments.Text()+segments.Data():
+		return dataRegion
+	case offset < segments.Text()+segments.Data()+segments.Space():
+		return spaceRegion
+	default:
+		return freeRegion
+	}
+}
+
+func describeAddress(address uint16) string {
+	description := fmt.Sprintf("Endereço %03d: %s", address, regionNames[regionOf(address)])
+	if address >= machine.ProgramBase() {
+		if label := labelAt(address - machine.ProgramBase()); label != "" {
+			description += " (" + label + ")"
+		}
+		if source := sourceAt(address - machine.ProgramBase()); source != "" {
+			description += ", " + source
+		}
+	}
+	return description
+}
+
+// forgets writes done while loading or resetting, so they don't flash
+func syncMemorySnapshot() {
+	previousMemory = machine.Memory()
+}
+
+func updateMemory() {
+	mem.RemoveAll()
+	for i, value := range machine.Memory() {
+		address := uint16(i)
+		regionColor := regionColors[regionOf(address)]
+
+		background := canvas.NewRectangle(regionColor)
+		if i == selectedAddress {
+			background.StrokeColor = color.White
+			background.StrokeWidth = 2
+		}
+		if value != previousMemory[i] {
+			flash := canvas.NewColorRGBAAnimation(flashColor, regionColor, flashDuration,
+				func(c color.Color) {
+					background.FillColor = c
+					background.Refresh()
+				})
+			flash.Start()
+		}
+
+		textAddress := canvas.NewText(fmt.Sprintf("%03d", i), color.White)
+		textValue := canvas.NewText("["+fmt.Sprintf("%03d", value)+"]", color.RGBA{R: 255, B: 0, G: 255, A: 255})
+		cont := container.NewStack(background, container.NewHBox(textAddress, textValue))
+
+		mem.Add(newMemoryCell(address, cont))
+	}
+	previousMemory = machine.Memory()
+}
+
+func memory() fyne.Widget {
+	memoryScroll.SetMinSize(fyne.NewSize(300, 650))
+
+	backgroundColor := color.RGBA{R: 0, B: 0, G: 0, A: 50}
+	background := canvas.NewRectangle(backgroundColor)
+
+	withBackground := container.NewStack(background, memoryScroll)
+	return widget.NewCard("Memória", "",
+		container.NewVBox(withBackground, legend(), hoverInfo))
+}
+
+func legend() *fyne.Container {
+	legend := container.NewGridWithColumns(3)
+	for r := reservedRegion; r <= freeRegion; r++ {
+		swatch := canvas.NewRectangle(regionColors[r])
+		swatch.SetMinSize(fyne.NewSize(12, 12))
+		legend.Add(container.NewHBox(swatch, widget.NewLabel(regionNames[r])))
+	}
+	return legend
+}
@@ -0,0 +1,43 @@
+package gui
+
+import (
+	"fmt"
+	"saturn/shared"
+
+	"fyne.io/fyne/v2/widget"
+)
+
+// where each word of the loaded image came from, sorted by address
+var sourceMap []shared.SourceLocation
+
+// file and line that generated the word at offset in the image, empty if
+// it is not known
+func sourceAt(offset uint16) string {
+	location, ok := shared.Locate(sourceMap, offset)
+	if !ok {
+		return ""
+	}
+	return location.String()
+}
+
+// executes one instruction. A fault stops the machine and is listed with
+// the diagnostics of the build, at the line of the instruction that
+// caused it.
+func step() bool {
+	pc := machine.PC()
+	err := machine.Execute()
+	if err == nil {
+		return true
+	}
+
+	diagnostic := shared.Diagnostic{
+		Severity: shared.Error,
+		Code:     shared.CodeRuntime,
+		Message:  fmt.Sprintf("falha no endereço %d: %v", pc, err)}
+	if location, ok := shared.Locate(sourceMap, pc); ok {
+		diagnostic.File, diagnostic.Line = location.File, location.Line
+	}
+	markErrors([]shared.Diagnostic{diagnostic})
+	errorsList.Add(widget.NewLabel(diagnostic.String()))
+	return false
+}
@@ -0,0 +1,82 @@
+package gui
+
+import (
+	"fmt"
+	"image/color"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+var stack = container.NewVBox()
+
+// program address to label, filled when the program's symbols are known
+var symbolNames = map[uint16]string{}
+
+var (
+	stackOkColor      = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	stackWarningColor = color.RGBA{R: 255, G: 200, B: 0, A: 255}
+	stackFullColor    = color.RGBA{R: 255, G: 60, B: 60, A: 255}
+)
+
+func labelAt(address uint16) string {
+	return symbolNames[address]
+}
+
+func stackPanel() fyne.Widget {
+	scrollable := container.NewVScroll(stack)
+	scrollable.SetMinSize(fyne.NewSize(300, 200))
+	return widget.NewCard("Pilha", "", scrollable)
+}
+
+// a full stack means the next CALL overflows, three quarters is a warning
+func stackColor(stackPointer, stackLimit uint16) color.Color {
+	if stackPointer >= stackLimit {
+		return stackFullColor
+	}
+	if 4*stackPointer >= 3*stackLimit {
+		return stackWarningColor
+	}
+	return stackOkColor
+}
+
+func updateStack() {
+	stack.RemoveAll()
+
+	memory := machine.Memory()
+	base := machine.StackBase()
+	limit := machine.StackLimit()
+	stackPointer := machine.SP()
+	riskColor := stackColor(stackPointer, limit)
+
+	stack.Add(canvas.NewText(
+		fmt.Sprintf("[%03d] Limite: %d", base, memory[base]), color.White))
+	stack.Add(canvas.NewText(
+		fmt.Sprintf("Stack Pointer: %d / %d", stackPointer, limit), riskColor))
+	if stackPointer >= limit {
+		stack.Add(canvas.NewText("Pilha cheia, o próximo CALL estoura a pilha", riskColor))
+	}
+
+	if stackPointer == 0 {
+		stack.Add(canvas.NewText("Pilha vazia", color.White))
+		return
+	}
+
+	// top of the stack first
+	for i := stackPointer; i >= 1; i-- {
+		address := base + i
+		returnAddress := uint16(memory[address])
+
+		frame := fmt.Sprintf("[%03d] #%d retorno: %03d", address, i, returnAddress)
+		if label := labelAt(returnAddress); label != "" {
+			frame += " (" + label + ")"
+		}
+		if i == stackPointer {
+			frame += " <- SP"
+		}
+
+		stack.Add(canvas.NewText(frame, riskColor))
+	}
+}
@@ -0,0 +1,105 @@
+package gui
+
+import (
+	"fmt"
+	"saturn/shared"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+var symbols []shared.Symbol
+var filteredSymbols []shared.Symbol
+var symbolSearch = widget.NewEntry()
+var symbolList *widget.List
+
+// memory cell selected from the symbol list, -1 if none
+var selectedAddress = -1
+
+func loadSymbols(loaded []shared.Symbol) {
+	symbols = loaded
+	selectedAddress = -1
+
+	// a global name wins over a local one at the same address
+	symbolNames = map[uint16]string{}
+	for _, symbol := range symbols {
+		if _, ok := symbolNames[symbol.Address]; !ok || symbol.Global {
+			symbolNames[symbol.Address] = symbol.Name
+		}
+	}
+
+	filterSymbols(symbolSearch.Text)
+}
+
+func filterSymbols(search string) {
+	search = strings.ToUpper(search)
+	filteredSymbols = nil
+	for _, symbol := range symbols {
+		if strings.Contains(symbol.Name, search) ||
+			strings.Contains(symbol.Module, search) {
+			filteredSymbols = append(filteredSymbols, symbol)
+		}
+	}
+
+	if symbolList != nil {
+		symbolList.UnselectAll()
+		symbolList.Refresh()
+	}
+}
+
+func describeSymbol(symbol shared.Symbol) string {
+	scope := "local"
+	if symbol.Global {
+		scope = "global"
+	}
+	return fmt.Sprintf("%-8s %03d %s (%s)",
+		symbol.Name, symbol.Address, symbol.Module, scope)
+}
+
+// scrolls the memory view so the cell at address is visible and selects it
+func goToAddress(address uint16) {
+	selectedAddress = int(address)
+	updateMemory()
+
+	columns := 4
+	rows := (len(machine.Memory()) + columns - 1) / columns
+	rowHeight := mem.Size().Height / float32(rows)
+	offset := rowHeight * float32(int(address)/columns)
+
+	maxOffset := mem.Size().Height - memoryScroll.Size().Height
+	if offset > maxOffset {
+		offset = maxOffset
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	memoryScroll.Offset = fyne.NewPos(0, offset)
+	memoryScroll.Refresh()
+}
+
+func symbolsPanel() fyne.Widget {
+	symbolSearch.SetPlaceHolder("Buscar símbolo")
+	symbolSearch.OnChanged = filterSymbols
+
+	symbolList = widget.NewList(
+		func() int {
+			return len(filteredSymbols)
+		},
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.TextStyle = fyne.TextStyle{Monospace: true}
+			return label
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			item.(*widget.Label).SetText(describeSymbol(filteredSymbols[id]))
+		})
+	symbolList.OnSelected = func(id widget.ListItemID) {
+		goToAddress(machine.ProgramBase() + filteredSymbols[id].Address)
+	}
+
+	listSize := container.NewGridWrap(fyne.NewSize(300, 200), symbolList)
+
+	return widget.NewCard("Símbolos", "", container.NewVBox(symbolSearch, listSize))
+}
@@ -3,95 +3,275 @@ package linker
 import (
 	"bufio"
 	"errors"
-	"os"
+	"fmt"
+	"io"
+	"saturn/assembler"
 	"saturn/shared"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 type SegmentSizes struct {
-	text  []int
-	data  []int
-	space []int
+	text       []int
+	data       []int
+	space      []int
+	placements [][]placement // of each module
 }
 
-func Run(
-	definitionTables []map[string]shared.SymbolInfo,
-	useTables []map[string][]uint16,
-	programNames []string,
-	programSizes []uint16,
-	stackSizes []uint16) (uint16, string) {
+// total text size of the linked program, the segment starts at address 0
+func (segmentSizes SegmentSizes) Text() int {
+	return sum(segmentSizes.text)
+}
+
+// total data size of the linked program, the segment follows the text
+func (segmentSizes SegmentSizes) Data() int {
+	return sum(segmentSizes.data)
+}
+
+// total space size of the linked program, the segment follows the data
+func (segmentSizes SegmentSizes) Space() int {
+	return sum(segmentSizes.space)
+}
 
-	if len(definitionTables) == 0 {
-		return 0, ""
+func sum(sizes []int) int {
+	total := 0
+	for _, size := range sizes {
+		total += size
 	}
-	if len(programNames) == 0 {
-		panic("caminho inalcançavel inesperadamente alcançado")
+	return total
+}
+
+type segment int
+
+const (
+	textSegment segment = iota
+	dataSegment
+	spaceSegment
+)
+
+// words of a module that go together into the linked program, the object
+// lines from local to local+size
+type placement struct {
+	local  int
+	global int
+	size   int
+}
+
+// a line of an object file, with the segment it is linked into and the
+// number of words it takes
+type objectLine struct {
+	fields  []string
+	segment segment
+	size    int
+}
+
+// a linked program, with the text of the files written for it
+type Image struct {
+	Name       string // of the first module, which names the files
+	Executable string // as in the .hpx file
+	Program    []shared.Word
+	Symbols    []shared.Symbol         // as in the .sym file, sorted by address
+	SourceMap  []shared.SourceLocation // as in the .map file, sorted by address
+	Segments   SegmentSizes
+	StackSize  uint16
+	Start      uint16 // address where execution starts
+}
+
+// text lines are "opcode [value mode [value mode]]", data lines "value A",
+// space lines "XX A", gaps "GAP n" and ORGs to a number "ORG n A". Gaps and
+// ORGs belong to the segment of the line before them.
+func parseObject(object string) ([]objectLine, error) {
+	var lines []objectLine
+	previous := textSegment
+	scanner := bufio.NewScanner(strings.NewReader(object))
+	lineCounter := 0
+	for scanner.Scan() {
+		lineCounter++
+		lineFields := strings.Fields(scanner.Text())
+		if len(lineFields) == 0 {
+			continue
+		}
+		line := objectLine{fields: lineFields}
+		switch {
+		case lineFields[0] == "A" || lineFields[0] == "R":
+			return nil, fmt.Errorf("linha %d do objeto começa com o modo %s", lineCounter, lineFields[0])
+		case lineFields[0] == "GAP":
+			size, err := objectNumber(lineFields)
+			if err != nil {
+				return nil, fmt.Errorf("linha %d do objeto: GAP %w", lineCounter, err)
+			}
+			line.segment = previous
+			line.size = size
+		case lineFields[0] == "ORG":
+			if _, err := objectNumber(lineFields); err != nil {
+				return nil, fmt.Errorf("linha %d do objeto: ORG %w", lineCounter, err)
+			}
+			line.segment = previous
+		case lineFields[0] == "XX":
+			line.segment = spaceSegment
+			line.size = 1
+
+			// only data and space can have size 2
+		case len(lineFields) == 2:
+			line.segment = dataSegment
+			line.size = 1
+		default:
+			line.segment = textSegment
+			for _, field := range lineFields {
+				if field != "A" && field != "R" {
+					line.size++
+				}
+			}
+		}
+		previous = line.segment
+		lines = append(lines, line)
 	}
 
-	globalSymbolTable, segmentSizes :=
-		firstPass(definitionTables, useTables, programNames, programSizes)
+	return lines, scanner.Err()
+}
 
-	secondPass(useTables, programNames, globalSymbolTable, segmentSizes)
+// the number after GAP or ORG
+func objectNumber(lineFields []string) (int, error) {
+	if len(lineFields) < 2 {
+		return 0, errors.New("sem número")
+	}
+	number, err := strconv.Atoi(lineFields[1])
+	if err != nil || number < 0 {
+		return 0, errors.New("com número inválido " + lineFields[1])
+	}
+	return number, nil
+}
+
+// Link relocates and joins modules in memory, in the given order. The
+// modules of a program with errors are not worth linking, so they should
+// have none.
+func Link(modules []assembler.Module) (Image, []shared.Diagnostic) {
+	if len(modules) == 0 {
+		return Image{}, []shared.Diagnostic{{
+			Severity: shared.Error,
+			Code:     shared.CodeProgram,
+			Message:  "nenhum módulo para ligar"}}
+	}
+
+	var objects [][]objectLine
+	var definitionTables, symbolTables []map[string]shared.SymbolInfo
+	var useTables []map[string][]uint16
+	var programNames []string
+	image := Image{Name: modules[0].Name}
+	var diagnostics []shared.Diagnostic
+	for _, module := range modules {
+		object, err := parseObject(module.Object)
+		if err != nil {
+			diagnostics = append(diagnostics, shared.Diagnostic{
+				File:     module.Name + ".obj",
+				Severity: shared.Error,
+				Code:     shared.CodeObject,
+				Message:  err.Error()})
+		}
+		objects = append(objects, object)
+		definitionTables = append(definitionTables, module.DefinitionTable)
+		symbolTables = append(symbolTables, module.SymbolTable)
+		programNames = append(programNames, module.Name)
+		image.StackSize += module.StackSize
+
+		// relocated in place, the module may be linked again
+		useTable := map[string][]uint16{}
+		for symbol, uses := range module.UseTable {
+			useTable[symbol] = slices.Clone(uses)
+		}
+		useTables = append(useTables, useTable)
+	}
+	if shared.HasErrors(diagnostics) {
+		return Image{}, diagnostics
+	}
+
+	globalSymbolTable, segmentSizes, diagnostics :=
+		firstPass(objects, definitionTables, useTables, programNames)
+	if shared.HasErrors(diagnostics) {
+		return Image{}, diagnostics
+	}
+
+	// execution starts in the first module that says where
+	startModule := slices.IndexFunc(modules, func(module assembler.Module) bool {
+		return module.Start != -1
+	})
+	if startModule == -1 {
+		return Image{}, append(diagnostics, shared.Diagnostic{
+			Severity: shared.Error,
+			Code:     shared.CodeProgram,
+			Message:  "faltando indicação de onde começar a execução"})
+	}
+	image.Start = uint16(relocateRelativeAddress(
+		modules[startModule].Start, startModule, segmentSizes))
+
+	var executable strings.Builder
+	diagnostics = append(diagnostics, secondPass(&executable, objects, useTables,
+		globalSymbolTable, segmentSizes, programNames)...)
+	if shared.HasErrors(diagnostics) {
+		return Image{}, diagnostics
+	}
+	image.Executable = executable.String()
+	var err error
+	image.Program, err = shared.ParseProgram(strings.NewReader(image.Executable))
+	if err != nil {
+		return Image{}, append(diagnostics, shared.Diagnostic{
+			Severity: shared.Error,
+			Code:     shared.CodeInternal,
+			Message:  err.Error()})
+	}
+	image.Symbols = symbols(definitionTables, symbolTables, programNames,
+		globalSymbolTable, segmentSizes)
+	image.SourceMap = sourceMap(modules, segmentSizes)
+	image.Segments = segmentSizes
+	return image, diagnostics
+}
 
-	totalStackSize := uint16(0)
-	for _, size := range stackSizes {
-		totalStackSize += size
+// writes the image's .hpx, .sym and .map files to directory, usually
+// shared.BuildDirectory
+func (image Image) WriteFiles(directory string) error {
+	err := shared.WriteBuildFile(directory, image.Name+".hpx", func(file io.Writer) error {
+		_, err := io.WriteString(file, image.Executable)
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	return totalStackSize, programNames[0]
+	err = shared.WriteBuildFile(directory, image.Name+".sym", func(file io.Writer) error {
+		return writeSymbols(file, image.Symbols)
+	})
+	if err != nil {
+		return err
+	}
+	return shared.WriteBuildFile(directory, image.Name+".map", func(file io.Writer) error {
+		return writeSourceMap(file, image.SourceMap)
+	})
 }
 
 func firstPass(
+	objects [][]objectLine,
 	definitionTables []map[string]shared.SymbolInfo,
 	useTables []map[string][]uint16,
-	programNames []string,
-	programSizes []uint16) (
+	programNames []string) (
 	globalSymbolTable map[string]shared.SymbolInfo,
-	segmentSizes SegmentSizes) {
+	segmentSizes SegmentSizes,
+	diagnostics []shared.Diagnostic) {
 
 	globalSymbolTable = map[string]shared.SymbolInfo{}
-	for i := range programSizes {
-		programFile, err := shared.OpenBuildFile(programNames[i] + ".obj")
-		if err != nil {
-			panic(err)
-		}
-		scanner := bufio.NewScanner(programFile)
-		textSize := 0
-		dataSize := 0
-		spaceSize := 0
-		for scanner.Scan() {
-			lineFields := strings.Fields(scanner.Text())
-			if lineFields[0] == "XX" {
-				spaceSize++
-
-				// only data and space can have size 2
-			} else if len(lineFields) == 2 {
-				dataSize++
-
-			} else {
-				for _, field := range lineFields {
-					if field != "A" && field != "R" {
-						textSize++
-					}
-				}
-			}
+	for _, object := range objects {
+		sizes := map[segment]int{}
+		for _, line := range object {
+			sizes[line.segment] += line.size
 		}
 
-		segmentSizes.text = append(segmentSizes.text, textSize)
-		segmentSizes.data = append(segmentSizes.data, dataSize)
-		segmentSizes.space = append(segmentSizes.space, spaceSize)
+		segmentSizes.text = append(segmentSizes.text, sizes[textSegment])
+		segmentSizes.data = append(segmentSizes.data, sizes[dataSegment])
+		segmentSizes.space = append(segmentSizes.space, sizes[spaceSegment])
 	}
+	segmentSizes.placements = placements(objects, segmentSizes)
 
-	for program_idx := range programSizes {
-
-		// set correct address to start execution
-		if program_idx == shared.ProgramIndexOfStart {
-			shared.ProgramStart = relocateRelativeAddress(
-				shared.ProgramStart,
-				program_idx,
-				segmentSizes)
-		}
-
+	for program_idx := range objects {
 		// update useTables to global addresses
 		useTable := useTables[program_idx]
 		for symbol, uses := range useTable {
@@ -108,7 +288,12 @@ func firstPass(
 		definitionTable := definitionTables[program_idx]
 		for symbol, info := range definitionTable {
 			if _, ok := globalSymbolTable[symbol]; ok {
-				panic(errors.New("símbolo global já definido"))
+				diagnostics = append(diagnostics, shared.Diagnostic{
+					File:     programNames[program_idx] + ".obj",
+					Severity: shared.Error,
+					Code:     shared.CodeDuplicateGlobal,
+					Message:  "símbolo global " + symbol + " já definido"})
+				continue
 			}
 
 			globalAddress := info.Address
@@ -125,117 +310,142 @@ func firstPass(
 		}
 	}
 	// check if all used symbols were defined
-	for _, useTable := range useTables {
+	for program_idx, useTable := range useTables {
+		var symbols []string
 		for symbol := range useTable {
+			symbols = append(symbols, symbol)
+		}
+		sort.Strings(symbols)
+		for _, symbol := range symbols {
 			if _, defined := globalSymbolTable[symbol]; !defined {
-				panic(errors.New("simbolo " + symbol + " nao foi definido"))
+				diagnostics = append(diagnostics, shared.Diagnostic{
+					File:     programNames[program_idx] + ".obj",
+					Severity: shared.Error,
+					Code:     shared.CodeUndefinedSymbol,
+					Message:  "simbolo " + symbol + " nao foi definido"})
 			}
 		}
 	}
 
-	return globalSymbolTable, segmentSizes
+	return globalSymbolTable, segmentSizes, diagnostics
 }
 
+// writes the text of every module, then their data, then their space. An
+// ORG to a number is only right if the module was placed where it was
+// assembled, as the first module's text is.
 func secondPass(
+	hpxFile io.Writer,
+	objects [][]objectLine,
 	useTables []map[string][]uint16,
-	programNames []string,
 	globalSymbolTable map[string]shared.SymbolInfo,
-	segmentSizes SegmentSizes) {
-
-	hpxFile, err := shared.CreateBuildFile(programNames[0] + ".hpx")
-	if err != nil {
-		panic(err)
-	}
-	defer hpxFile.Close()
+	segmentSizes SegmentSizes,
+	programNames []string) (diagnostics []shared.Diagnostic) {
 
-	var programFiles []*os.File
-	for _, name := range programNames {
-		programFile, err := shared.OpenBuildFile(name + ".obj")
-		if err != nil {
-			panic(err)
-		}
-		programFiles = append(programFiles, programFile)
-		defer programFile.Close()
-	}
 	locationCounter := 0
-	sizeOfPreviousText := 0
-	sizeOfPreviousData := 0
-	// write text
-	for program_idx := range programNames {
-		programFile := programFiles[program_idx]
-		scanner := bufio.NewScanner(programFile)
-		for scanner.Scan() {
-			lineFields := strings.Fields(scanner.Text())
-			updateLineFieldsAddresses(lineFields,
-				globalSymbolTable,
-				useTables[program_idx],
-				&locationCounter,
-				segmentSizes,
-				program_idx)
-			writeHpxLine(hpxFile, lineFields)
-			textOver := locationCounter >=
-				sizeOfPreviousText+segmentSizes.text[program_idx]
-
-			if textOver {
-				break
+	for _, current := range []segment{textSegment, dataSegment, spaceSegment} {
+		for program_idx, object := range objects {
+			for _, line := range object {
+				if line.segment != current {
+					continue
+				}
+				if line.fields[0] == "ORG" {
+					if line.fields[1] != strconv.Itoa(locationCounter) {
+						diagnostics = append(diagnostics, shared.Diagnostic{
+							File:     programNames[program_idx] + ".obj",
+							Severity: shared.Error,
+							Code:     shared.CodeProgram,
+							Message: fmt.Sprintf("ORG %v ficou no endereço %v depois da ligação,"+
+								" use um endereço relativo", line.fields[1], locationCounter)})
+					}
+					continue
+				}
+				if line.fields[0] == "GAP" {
+					for i := 0; i < line.size; i++ {
+						writeHpxLine(hpxFile, []string{"00"})
+					}
+					locationCounter += line.size
+					continue
+				}
+
+				updateLineFieldsAddresses(line.fields,
+					globalSymbolTable,
+					useTables[program_idx],
+					&locationCounter,
+					segmentSizes,
+					program_idx)
+				writeHpxLine(hpxFile, line.fields)
 			}
 		}
-		sizeOfPreviousText += segmentSizes.text[program_idx]
 	}
+	return diagnostics
+}
 
-	//write data
-	for program_idx := range programNames {
-		programFile := programFiles[program_idx]
-		programFile.Seek(0, 0)
-		scanner := bufio.NewScanner(programFile)
+// every global and local symbol with its address in the linked program
+func symbols(
+	definitionTables []map[string]shared.SymbolInfo,
+	symbolTables []map[string]shared.SymbolInfo,
+	programNames []string,
+	globalSymbolTable map[string]shared.SymbolInfo,
+	segmentSizes SegmentSizes) []shared.Symbol {
 
-		for scanner.Scan() {
-			lineFields := strings.Fields(scanner.Text())
-			// skip text
-			if len(lineFields) != 2 {
+	// absolute symbols (EQU, SET) are values, not addresses
+	var symbols []shared.Symbol
+	for program_idx, name := range programNames {
+		for symbol, info := range definitionTables[program_idx] {
+			if info.Mode == shared.ABSOLUTE {
 				continue
 			}
-			updateLineFieldsAddresses(lineFields,
-				globalSymbolTable,
-				useTables[program_idx],
-				&locationCounter,
-				segmentSizes,
-				program_idx)
-			writeHpxLine(hpxFile, lineFields)
-			totalTextSize := sizeOfPreviousText
-			dataOver := locationCounter >= totalTextSize+
-				sizeOfPreviousData+segmentSizes.data[program_idx]
-
-			if dataOver {
-				break
-			}
+			symbols = append(symbols, shared.Symbol{
+				Name:    symbol,
+				Address: globalSymbolTable[symbol].Address,
+				Module:  name,
+				Global:  true})
 		}
-		sizeOfPreviousData += segmentSizes.data[program_idx]
-	}
 
-	// write space
-	for program_idx := range programNames {
-		programFile := programFiles[program_idx]
-		programFile.Seek(0, 0)
-		scanner := bufio.NewScanner(programFile)
-		for scanner.Scan() {
-			lineFields := strings.Fields(scanner.Text())
-			// skip text and data
-			if lineFields[0] != "XX" {
+		for symbol, info := range symbolTables[program_idx] {
+			_, isGlobal := definitionTables[program_idx][symbol]
+			if isGlobal || info.Mode == shared.ABSOLUTE {
 				continue
 			}
-			updateLineFieldsAddresses(lineFields,
-				globalSymbolTable,
-				useTables[program_idx],
-				&locationCounter,
-				segmentSizes,
-				program_idx)
-			writeHpxLine(hpxFile, lineFields)
+
+			address := info.Address
+			if info.Mode == shared.RELATIVE {
+				address = uint16(relocateRelativeAddress(
+					int(address), program_idx, segmentSizes))
+			}
+			symbols = append(symbols, shared.Symbol{
+				Name:    symbol,
+				Address: address,
+				Module:  name})
+		}
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Address != symbols[j].Address {
+			return symbols[i].Address < symbols[j].Address
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
+
+// one "NAME ADDRESS MODULE G|L" line per symbol
+func writeSymbols(symFile io.Writer, symbols []shared.Symbol) error {
+	for _, symbol := range symbols {
+		scope := 'L'
+		if symbol.Global {
+			scope = 'G'
+		}
+		_, err := fmt.Fprintf(symFile, "%s %d %s %c\n",
+			symbol.Name, symbol.Address, symbol.Module, scope)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func writeHpxLine(hpxFile *os.File, lineFields []string) {
+func writeHpxLine(hpxFile io.Writer, lineFields []string) {
 	var hpxLine string
 	for i := range lineFields {
 		if lineFields[i] != "A" && lineFields[i] != "R" {
@@ -251,10 +461,10 @@ func writeHpxLine(hpxFile *os.File, lineFields []string) {
 			hpxLine += "\n"
 		}
 	}
-	hpxFile.WriteString(hpxLine)
+	io.WriteString(hpxFile, hpxLine)
 }
 
-// updates external addresses (00 A) to actual addresses
+// updates external addresses (offset A) to actual addresses
 // updates locationCounter
 func updateLineFieldsAddresses(
 	lineFields []string,
@@ -265,18 +475,17 @@ func updateLineFieldsAddresses(
 	program_idx int) {
 
 	for i := range lineFields {
-		// 00 A is sentinel value for INTDEF/INTUSE? value
-		if lineFields[i] == "00" {
-			// cant break bounds because of way obj files are created
-			if lineFields[i+1] == "A" {
-				for symbol, useAddresses := range useTable {
-					for _, useAddress := range useAddresses {
-						if useAddress == uint16(*locationCounter) {
-							address := strconv.Itoa(
-								int(globalSymbolTable[symbol].Address))
-
-							lineFields[i] = address
-						}
+		// a use of an INTUSE symbol is an absolute offset from its address,
+		// usually 00 A
+		if i+1 < len(lineFields) && lineFields[i+1] == "A" {
+			for symbol, useAddresses := range useTable {
+				for _, useAddress := range useAddresses {
+					if useAddress == uint16(*locationCounter) {
+						offset, _ := strconv.Atoi(lineFields[i])
+						address := strconv.Itoa(
+							offset + int(globalSymbolTable[symbol].Address))
+
+						lineFields[i] = address
 					}
 				}
 			}
@@ -294,42 +503,63 @@ func updateLineFieldsAddresses(
 	}
 }
 
+// where the lines of each object go: the text of every module, then their
+// data, then their space. Lines keep their order within a segment, so data
+// placed between instructions still ends up with the rest of the data.
+func placements(objects [][]objectLine, segmentSizes SegmentSizes) [][]placement {
+	var placements [][]placement
+	previous := map[segment]int{
+		textSegment:  0,
+		dataSegment:  segmentSizes.Text(),
+		spaceSegment: segmentSizes.Text() + segmentSizes.Data()}
+	for program_idx, object := range objects {
+		next := map[segment]int{}
+		for segment, address := range previous {
+			next[segment] = address
+		}
+
+		var modulePlacements []placement
+		local := 0
+		for _, line := range object {
+			if line.size == 0 {
+				continue
+			}
+			last := len(modulePlacements) - 1
+			if last >= 0 && modulePlacements[last].global+modulePlacements[last].size ==
+				next[line.segment] {
+				modulePlacements[last].size += line.size
+			} else {
+				modulePlacements = append(modulePlacements,
+					placement{local: local, global: next[line.segment], size: line.size})
+			}
+			next[line.segment] += line.size
+			local += line.size
+		}
+		placements = append(placements, modulePlacements)
+
+		previous[textSegment] += segmentSizes.text[program_idx]
+		previous[dataSegment] += segmentSizes.data[program_idx]
+		previous[spaceSegment] += segmentSizes.space[program_idx]
+	}
+	return placements
+}
+
+// the address in the linked program of a relative address of a module. An
+// address past the last word of the module follows that word.
 func relocateRelativeAddress(
 	address,
 	program_idx int,
 	segmentSizes SegmentSizes) int {
 
-	currentProgramTextSize := segmentSizes.text[program_idx]
-	currentProgramDataSize := segmentSizes.data[program_idx]
-	totalTextSize := 0
-	totalDataSize := 0
-	totalSpaceSize := 0
-	sizeOfPreviousText := 0
-	sizeOfPreviousData := 0
-	sizeOfPreviousSpace := 0
-	for i := range segmentSizes.text {
-		totalTextSize += segmentSizes.text[i]
-		totalDataSize += segmentSizes.data[i]
-		totalSpaceSize += segmentSizes.space[i]
-		if i < program_idx {
-			sizeOfPreviousText += segmentSizes.text[i]
-			sizeOfPreviousData += segmentSizes.data[i]
-			sizeOfPreviousSpace += segmentSizes.space[i]
+	placements := segmentSizes.placements[program_idx]
+	i := sort.Search(len(placements), func(i int) bool {
+		return placements[i].local > address
+	}) - 1
+	if i < 0 {
+		if len(placements) == 0 {
+			return address
 		}
+		i = 0
 	}
-
-	isText := address < currentProgramTextSize
-	isData := address >= currentProgramTextSize &&
-		address < currentProgramTextSize+currentProgramDataSize
-
-	otherTextSize := totalTextSize - currentProgramTextSize
-	otherDataSize := totalDataSize - currentProgramDataSize
-	if isText {
-		address += sizeOfPreviousText
-	} else if isData {
-		address += otherTextSize + sizeOfPreviousData
-	} else {
-		address += otherTextSize + otherDataSize + sizeOfPreviousSpace
-	}
-	return address
+	return placements[i].global + address - placements[i].local
 }
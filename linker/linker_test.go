@@ -2,12 +2,161 @@ package linker
 
 import (
 	"saturn/assembler"
+	"saturn/mp"
+	"saturn/shared"
+	"slices"
 	"testing"
 )
 
+// assembles and links the files in paths in memory, as a build would
+func link(paths ...string) (Image, []shared.Diagnostic) {
+	sources, diagnostics := assembler.ReadSources(paths...)
+	modules, assembleDiagnostics := assembler.Assemble(mp.Options{}, sources...)
+	diagnostics = append(diagnostics, assembleDiagnostics...)
+	if shared.HasErrors(diagnostics) {
+		return Image{}, diagnostics
+	}
+	image, linkDiagnostics := Link(modules)
+	return image, append(diagnostics, linkDiagnostics...)
+}
+
 func TestRun(t *testing.T) {
-	_, _ = Run(assembler.Run("linker_test.asm", "linker_test_part2.asm"))
-	_, _ = Run(assembler.Run("linker_test_3.asm", "linker_test_3.asm"))
+	_, diagnostics := link("linker_test.asm", "linker_test_part2.asm")
+	if shared.HasErrors(diagnostics) {
+		t.Fatalf("erros inesperados: %v", diagnostics)
+	}
+
+	// linker_test_3.asm has no END, so it is never linked
+	_, diagnostics = link("linker_test_3.asm", "linker_test_3.asm")
+	missingEnd := 0
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == shared.Error && diagnostic.Message == `sem instrução "end"` {
+			missingEnd++
+		}
+	}
+	if missingEnd != 2 {
+		t.Fatalf("esperava-se falta de END nos dois módulos, obteve-se %v", diagnostics)
+	}
 	// todo: compare first run with MAIN_test goal
-	// and second run with TESTE3_test goal
+}
+
+func TestEntryPoint(t *testing.T) {
+	// MAIN starts at its label MAIN, HELPER has no entry point
+	image, _ := link("linker_test.asm", "linker_test_part2.asm")
+	if image.Start != 4 {
+		t.Fatalf("esperava-se início em 4, obteve-se %v", image.Start)
+	}
+
+	// the text of HELPER now comes first
+	image, _ = link("linker_test_part2.asm", "linker_test.asm")
+	if image.Start != 8 {
+		t.Fatalf("esperava-se início em 8, obteve-se %v", image.Start)
+	}
+}
+
+func TestGaps(t *testing.T) {
+	image, _ := link("linker_test_org.asm")
+
+	want := []shared.Word{
+		131, 12, 11, 0, 0, 0, 0, 0, 128, 0, 0, 0, // text, aligned to 4
+		1, 0, 0, 0, 2, 0, 0, 3} // data with reserved words
+	program := image.Program
+	if len(program) != len(want) {
+		t.Fatalf("esperava-se programa com %v palavras, obteve-se %v",
+			len(want), program)
+	}
+	for i := range want {
+		if program[i] != want[i] {
+			t.Fatalf("palavra %v: esperava-se %v, obteve-se %v",
+				i, want[i], program[i])
+		}
+	}
+}
+
+func TestDataBetweenInstructions(t *testing.T) {
+	// X is declared between LOAD and STORE but goes with the data, after
+	// the 7 words of text
+	image, diagnostics := link("linker_test_mixed.asm")
+	if shared.HasErrors(diagnostics) {
+		t.Fatalf("erros inesperados: %v", diagnostics)
+	}
+
+	want := []shared.Word{131, 7, 135, 8, 131, 7, 11, 5, 0}
+	if !slices.Equal(image.Program, want) {
+		t.Fatalf("esperava-se %v, obteve-se %v", want, image.Program)
+	}
+	location, _ := shared.Locate(image.SourceMap, 2)
+	if location.Line != 4 || location.Symbol != "MIXED+2" {
+		t.Fatalf("endereço 2: esperava-se linker_test_mixed.asm:4 (MIXED+2), obteve-se %+v",
+			location)
+	}
+}
+
+func TestAbsoluteOrigin(t *testing.T) {
+	// ORG 8 holds in the first module, but the text of FIXED follows the
+	// 12 words of ORGS, so its ORG 4 ends up at 16
+	_, diagnostics := link("linker_test_org.asm", "linker_test_org2.asm")
+	var errors []shared.Diagnostic
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == shared.Error {
+			errors = append(errors, diagnostic)
+		}
+	}
+	if len(errors) != 1 || errors[0].Code != shared.CodeProgram ||
+		errors[0].File != "FIXED.obj" {
+		t.Fatalf("esperava-se um erro no ORG de FIXED, obteve-se %v", diagnostics)
+	}
+}
+
+func TestNoModules(t *testing.T) {
+	_, diagnostics := Link(nil)
+	if len(diagnostics) != 1 || diagnostics[0].Code != shared.CodeProgram {
+		t.Fatalf("esperava-se um erro de programa, obteve-se %v", diagnostics)
+	}
+}
+
+func TestBadObject(t *testing.T) {
+	// a GAP without its size, as no assembler writes it
+	module := assembler.Module{Name: "BAD", Object: "128\nGAP\n", Start: 0}
+	_, diagnostics := Link([]assembler.Module{module})
+	if len(diagnostics) != 1 || diagnostics[0].Code != shared.CodeObject ||
+		diagnostics[0].File != "BAD.obj" {
+		t.Fatalf("esperava-se um erro no objeto de BAD, obteve-se %v", diagnostics)
+	}
+}
+
+func TestUndefinedExternal(t *testing.T) {
+	// SYMBOL3 and SYMBOL4 are defined by linker_test_part2.asm
+	_, diagnostics := link("linker_test.asm")
+
+	undefined := 0
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Code == shared.CodeUndefinedSymbol {
+			undefined++
+		}
+	}
+	if undefined != 2 {
+		t.Fatalf("esperava-se 2 símbolos externos indefinidos, obteve-se %v", diagnostics)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	image, _ := link("linker_test.asm", "linker_test_part2.asm")
+	locations := image.SourceMap
+
+	// the first word of HELPER follows the text of MAIN
+	location, ok := shared.Locate(locations, 11)
+	if !ok || location.Module != "HELPER" || location.Line != 7 ||
+		location.File != "linker_test_part2.asm" {
+		t.Fatalf("endereço 11: esperava-se linker_test_part2.asm:7, obteve-se %+v", location)
+	}
+
+	location, _ = shared.Locate(locations, 6)
+	if location.Module != "MAIN" || location.Line != 9 || location.Symbol != "MAIN+2" {
+		t.Fatalf("endereço 6: esperava-se linker_test.asm:9 (MAIN+2), obteve-se %+v", location)
+	}
+
+	if _, ok := shared.Locate(locations, 0); !ok {
+		t.Fatal("endereço 0 deveria estar no mapa")
+	}
 }
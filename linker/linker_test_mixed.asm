@@ -0,0 +1,8 @@
+      START  MIXED
+MIXED LOAD   X
+X     CONST  5
+      STORE  Y
+      LOAD   X
+      STOP
+Y     SPACE
+      END
@@ -0,0 +1,12 @@
+      START  ORGS
+ORGS  LOAD   TAB
+      STOP
+      ORG    8
+VEC   BR     ORGS
+      ALIGN  4
+TAB   CONST  1
+BUF   RESERVE 3
+LAST  CONST  2
+      ORG    LAST+3
+FINAL CONST  3
+      END
@@ -0,0 +1,5 @@
+      START  FIXED
+      STOP
+      ORG    4
+      STOP
+      END
@@ -0,0 +1,98 @@
+package linker
+
+import (
+	"fmt"
+	"io"
+	"saturn/assembler"
+	"saturn/shared"
+	"sort"
+	"strings"
+)
+
+// a label of a module at its address in the linked program
+type localLabel struct {
+	name    string
+	address int
+}
+
+// relocates the source lines of every module, the image address of each
+// object line with the closest label of its module before it
+func sourceMap(modules []assembler.Module, segmentSizes SegmentSizes) []shared.SourceLocation {
+	var locations []shared.SourceLocation
+	for program_idx, module := range modules {
+		relocate := func(address int) int {
+			return relocateRelativeAddress(address, program_idx, segmentSizes)
+		}
+		labels := moduleLabels(module.DefinitionTable, module.SymbolTable, relocate)
+		for _, location := range module.Lines {
+			address := relocate(int(location.Address))
+			location.Address = uint16(address)
+			location.Symbol = labelBefore(labels, address)
+			locations = append(locations, location)
+		}
+	}
+
+	sort.SliceStable(locations, func(i, j int) bool {
+		return locations[i].Address < locations[j].Address
+	})
+	return locations
+}
+
+// one "ADDRESS\tMODULE\tFILE\tLINE\tMACROS\tSYMBOL" line per object line
+func writeSourceMap(mapFile io.Writer, locations []shared.SourceLocation) error {
+	for _, location := range locations {
+		_, err := fmt.Fprintf(mapFile, "%d\t%s\t%s\t%d\t%s\t%s\n", location.Address,
+			location.Module, location.File, location.Line,
+			strings.Join(location.Macros, ">"), location.Symbol)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relative symbols of a module sorted by their relocated address, exported
+// ones included
+func moduleLabels(
+	definitionTable map[string]shared.SymbolInfo,
+	symbolTable map[string]shared.SymbolInfo,
+	relocate func(address int) int) []localLabel {
+
+	var labels []localLabel
+	for _, table := range []map[string]shared.SymbolInfo{definitionTable, symbolTable} {
+		for name, info := range table {
+			if info.Mode == shared.RELATIVE {
+				labels = append(labels, localLabel{name: name, address: relocate(int(info.Address))})
+			}
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].address != labels[j].address {
+			return labels[i].address < labels[j].address
+		}
+		return labels[i].name < labels[j].name
+	})
+	return labels
+}
+
+// closest label at or before address, as LABEL or LABEL+offset
+func labelBefore(labels []localLabel, address int) string {
+	i := sort.Search(len(labels), func(i int) bool {
+		return labels[i].address > address
+	})
+	if i == 0 {
+		return ""
+	}
+
+	// the first name among labels at the same address
+	label := labels[i-1]
+	for i > 1 && labels[i-2].address == label.address {
+		i--
+		label = labels[i-1]
+	}
+	if label.address == address {
+		return label.name
+	}
+	return fmt.Sprintf("%s+%d", label.name, address-label.address)
+}
@@ -1,21 +1,104 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
-	"saturn/assembler"
 	"saturn/gui"
-	"saturn/linker"
+	"saturn/mp"
+	"saturn/pipeline"
+	"saturn/shared"
+	"strconv"
+	"strings"
 )
 
+// a flag that may be given many times, like -I
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 func main() {
-	programs := os.Args[1:]
+	jsonOutput := flag.Bool("json", false,
+		"monta e liga sem abrir a interface, escrevendo os diagnósticos em JSON")
+	var includePaths listFlag
+	flag.Var(&includePaths, "I",
+		"diretório onde procurar arquivos de INCLUDE, pode ser repetido")
+	var defines listFlag
+	flag.Var(&defines, "D",
+		"define NOME=VALOR (ou NOME, valendo 1) para IF e IFDEF, pode ser repetido")
+	var macroLibraries listFlag
+	flag.Var(&macroLibraries, "maclib",
+		"arquivo ou diretório com macros, pode ser repetido")
+	maxDepth := flag.Int("macro-depth", 0,
+		"máximo de macros expandidas uma dentro da outra (0 para o padrão)")
+	maxLines := flag.Int("macro-lines", 0,
+		"máximo de linhas expandidas por chamada de macro no fonte (0 para o padrão)")
+	flag.Parse()
+
+	options := mp.Options{IncludePaths: includePaths, Defines: map[string]int{},
+		MacroLibraries: macroLibraries, MaxExpansionDepth: *maxDepth,
+		MaxExpandedLines: *maxLines}
+	for _, define := range defines {
+		name, value, err := parseDefine(define)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		options.Defines[name] = value
+	}
+
+	programs := flag.Args()
 	if len(programs) == 0 { // default
 		programs = append(programs, "linker/linker_test.asm")
 		programs = append(programs, "linker/linker_test_part2.asm")
 	}
 
-	stackLimit, programName := linker.Run(assembler.Run(programs...))
-	gui.Initialize(stackLimit)
-	gui.LoadProgram(ReadProgram(programName + ".hpx"))
-	gui.Run()
+	if *jsonOutput {
+		diagnostics := build(options, programs)
+		if err := shared.WriteDiagnosticsJSON(os.Stdout, diagnostics); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if shared.HasErrors(diagnostics) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	gui.Run(options, programs...)
+}
+
+// NAME=VALUE, or just NAME for 1
+func parseDefine(define string) (string, int, error) {
+	name, valueString, hasValue := strings.Cut(define, "=")
+	if name == "" {
+		return "", 0, fmt.Errorf("-D %s: faltando nome", define)
+	}
+	if !hasValue {
+		return name, 1, nil
+	}
+	value, err := strconv.Atoi(valueString)
+	if err != nil {
+		return "", 0, fmt.Errorf("-D %s: valor deve ser um número inteiro", define)
+	}
+	return name, value, nil
+}
+
+// builds programs and writes the results to the build directory
+func build(options mp.Options, programs []string) []shared.Diagnostic {
+	result, diagnostics := pipeline.BuildFiles(options, programs...)
+	if err := result.WriteFiles(shared.BuildDirectory); err != nil {
+		diagnostics = append(diagnostics, shared.Diagnostic{
+			Severity: shared.Error,
+			Code:     shared.CodeIO,
+			Message:  err.Error()})
+	}
+	return diagnostics
 }
@@ -0,0 +1,20 @@
+ MACRO
+ INNER &X
+ LOAD &X
+ AGO .NOWHERE
+ MEND
+*
+ MACRO
+ OUTER &X
+ ADD &X
+ INNER &X
+ MEND
+*
+ OUTER A
+ MACRO
+ BAD X
+ MEND
+*
+ MACRO
+ OPEN
+ LOAD @1
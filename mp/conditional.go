@@ -0,0 +1,156 @@
+package mp
+
+import (
+	"errors"
+	"saturn/shared"
+)
+
+// an IF, IFDEF or IFNDEF block being read
+type conditional struct {
+	file        string
+	line        uint16
+	enclosing   bool // whether the lines around the block are assembled
+	active      bool // whether the lines read now are assembled
+	branchTaken bool // whether the IF or the ELSE branch was chosen
+	hasElse     bool
+}
+
+// handles conditional assembly directives, reporting whether operation was
+// one. Directives are checked even in skipped blocks, so nesting is kept.
+func (macroProcessor *macroProcessor) conditionalDirective(
+	label, operation string, operands []string) bool {
+
+	switch operation {
+	case "IF", "IFDEF", "IFNDEF":
+		enclosing := !macroProcessor.skipping()
+		condition := false
+		if enclosing {
+			condition = macroProcessor.condition(label, operation, operands)
+		}
+		macroProcessor.conditionals = append(macroProcessor.conditionals, conditional{
+			file:        macroProcessor.fileName,
+			line:        macroProcessor.lineCounter,
+			enclosing:   enclosing,
+			active:      enclosing && condition,
+			branchTaken: condition})
+
+	case "ELSE":
+		block := macroProcessor.innermostConditional(operation)
+		if block == nil {
+			break
+		}
+		if block.hasElse {
+			macroProcessor.addError(shared.CodeConditional,
+				errors.New("mais de um ELSE para o mesmo IF"))
+			break
+		}
+		block.hasElse = true
+		block.active = block.enclosing && !block.branchTaken
+
+	case "ENDIF":
+		if macroProcessor.innermostConditional(operation) != nil {
+			macroProcessor.conditionals =
+				macroProcessor.conditionals[:len(macroProcessor.conditionals)-1]
+		}
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (macroProcessor *macroProcessor) condition(
+	label, operation string, operands []string) bool {
+
+	if label != "" {
+		macroProcessor.addError(shared.CodeConditional,
+			errors.New(operation+" não aceita rótulo"))
+	}
+
+	if operation == "IF" {
+		if len(operands) == 0 {
+			macroProcessor.addError(shared.CodeConditional,
+				errors.New("IF espera uma expressão"))
+			return false
+		}
+		value, err := evaluateWords(operands, func(expression string) (int, error) {
+			return evaluate(expression, macroProcessor.symbolValue)
+		})
+		if err != nil {
+			macroProcessor.addError(shared.CodeConditional, err)
+			return false
+		}
+		return value != 0
+	}
+
+	if len(operands) != 1 {
+		macroProcessor.addError(shared.CodeConditional,
+			errors.New(operation+" espera exatamente um símbolo"))
+		return false
+	}
+	_, defined := macroProcessor.symbolValue(operands[0])
+	defined = defined || macroProcessor.labels[operands[0]]
+	return defined == (operation == "IFDEF")
+}
+
+// the block an ELSE or ENDIF belongs to, which must be in the same file
+func (macroProcessor *macroProcessor) innermostConditional(operation string) *conditional {
+	depth := len(macroProcessor.conditionals)
+	if depth == macroProcessor.fileConditionals {
+		macroProcessor.addError(shared.CodeConditional, errors.New(operation+" sem IF"))
+		return nil
+	}
+	return &macroProcessor.conditionals[depth-1]
+}
+
+// lines inside a false branch are not written
+func (macroProcessor *macroProcessor) skipping() bool {
+	depth := len(macroProcessor.conditionals)
+	return depth != 0 && !macroProcessor.conditionals[depth-1].active
+}
+
+// reports blocks opened in the file that just ended and were never closed
+func (macroProcessor *macroProcessor) closeConditionals() {
+	for _, block := range macroProcessor.conditionals[macroProcessor.fileConditionals:] {
+		macroProcessor.diagnostics = append(macroProcessor.diagnostics, shared.Diagnostic{
+			File:     block.file,
+			Line:     int(block.line),
+			Severity: shared.Error,
+			Code:     shared.CodeConditional,
+			Message:  "faltando ENDIF"})
+	}
+	macroProcessor.conditionals = macroProcessor.conditionals[:macroProcessor.fileConditionals]
+}
+
+// reports blocks a macro opened and did not close before its expansion ended
+func (macroProcessor *macroProcessor) closeExpansionConditionals(name string) {
+	if len(macroProcessor.conditionals) == macroProcessor.fileConditionals {
+		return
+	}
+	macroProcessor.addError(shared.CodeConditional, errors.New("faltando ENDIF no macro "+name))
+	macroProcessor.conditionals = macroProcessor.conditionals[:macroProcessor.fileConditionals]
+}
+
+// values for IF come from -D and from EQU and SET lines already read
+func (macroProcessor *macroProcessor) symbolValue(name string) (int, bool) {
+	value, ok := macroProcessor.symbols[name]
+	return value, ok
+}
+
+// remembers labels and the values of EQU and SET lines with constant
+// expressions, for IF and IFDEF
+func (macroProcessor *macroProcessor) recordSymbol(label, operation string, operands []string) {
+	if label == "" {
+		return
+	}
+	macroProcessor.labels[label] = true
+	// only the first operand, as the assembler reads it: in X EQU 2 * 3 the
+	// "* 3" is a comment
+	if (operation == "EQU" || operation == "SET") && len(operands) != 0 {
+		value, err := evaluate(operands[0], macroProcessor.symbolValue)
+		if err == nil {
+			macroProcessor.symbols[label] = value
+		}
+	}
+}
@@ -0,0 +1,9 @@
+ ELSE
+ IF UNKNOWN
+ ENDIF
+ IF 1
+ ELSE
+ ELSE
+ ENDIF
+ IF 0
+ STOP
@@ -0,0 +1,30 @@
+LEVEL EQU 2
+ IF DEBUG
+ WRITE @1
+ IF LEVEL GT 1 AND NOT VERBOSE
+ WRITE @2
+ ELSE
+ WRITE @3
+ ENDIF
+ ELSE
+ WRITE @4
+ IF 1
+ WRITE @5
+ ENDIF
+ ENDIF
+ IFDEF LEVEL
+ WRITE @6
+ ENDIF
+ IFNDEF RELEASE
+ WRITE @7
+ ENDIF
+ IF 2 * 0
+ WRITE @8
+ ENDIF
+ IF LEVEL * 2 EQ 4
+ WRITE @9
+ ENDIF
+ IF DEBUG * only in debug
+ WRITE @10
+ ENDIF
+ STOP
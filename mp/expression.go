@@ -0,0 +1,160 @@
+package mp
+
+import (
+	"errors"
+	"saturn/parser"
+	"strings"
+	"unicode"
+)
+
+// macro-time expressions, evaluated while the source is read. Values are
+// integers, comparisons and logical operators give 1 or 0. The arithmetic
+// is parser.Arithmetic, the layers above it are read here:
+//
+//	expression  := conjunction {"OR" conjunction}
+//	conjunction := negation {"AND" negation}
+//	negation    := "NOT" negation | comparison
+//	comparison  := sum [("EQ" | "NE" | "LT" | "LE" | "GT" | "GE") sum]
+type macroExpression struct {
+	arithmetic *parser.Arithmetic[int]
+	value      func(name string) (int, bool)
+}
+
+var comparisons = map[string]func(a, b int) bool{
+	"EQ": func(a, b int) bool { return a == b },
+	"NE": func(a, b int) bool { return a != b },
+	"LT": func(a, b int) bool { return a < b },
+	"LE": func(a, b int) bool { return a <= b },
+	"GT": func(a, b int) bool { return a > b },
+	"GE": func(a, b int) bool { return a >= b },
+}
+
+// evaluates expression, looking names up with value
+func evaluate(expression string, value func(name string) (int, bool)) (int, error) {
+	e := &macroExpression{value: value}
+	arithmetic, err := parser.NewArithmetic[int](expression, e)
+	if err != nil {
+		return 0, err
+	}
+	e.arithmetic = arithmetic
+
+	result, err := e.expression()
+	if err != nil {
+		return 0, err
+	}
+	if err := arithmetic.End(); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// evaluates the words after IF or SETA. A "*" word after the operands
+// begins a comment, as on any other line, but a spaced "*" may also be a
+// multiplication: the words are one expression if they evaluate as one,
+// otherwise the expression ends at the last "*" word that leaves one that does
+func evaluateWords(words []string, evaluate func(expression string) (int, error)) (int, error) {
+	value, err := evaluate(strings.Join(words, " "))
+	if err == nil {
+		return value, nil
+	}
+	for i := len(words) - 1; i > 0; i-- {
+		if !strings.HasPrefix(words[i], "*") {
+			continue
+		}
+		if value, prefixErr := evaluate(strings.Join(words[:i], " ")); prefixErr == nil {
+			return value, nil
+		}
+	}
+	return 0, err
+}
+
+func (e *macroExpression) expression() (int, error) {
+	left, err := e.conjunction()
+	for err == nil && e.arithmetic.Peek() == "OR" {
+		e.arithmetic.Next()
+		var right int
+		right, err = e.conjunction()
+		left = truth(left != 0 || right != 0)
+	}
+	return left, err
+}
+
+func (e *macroExpression) conjunction() (int, error) {
+	left, err := e.negation()
+	for err == nil && e.arithmetic.Peek() == "AND" {
+		e.arithmetic.Next()
+		var right int
+		right, err = e.negation()
+		left = truth(left != 0 && right != 0)
+	}
+	return left, err
+}
+
+func (e *macroExpression) negation() (int, error) {
+	if e.arithmetic.Peek() == "NOT" {
+		e.arithmetic.Next()
+		value, err := e.negation()
+		return truth(value == 0), err
+	}
+	return e.comparison()
+}
+
+func (e *macroExpression) comparison() (int, error) {
+	left, err := e.arithmetic.Sum()
+	if err != nil {
+		return left, err
+	}
+	if compare, ok := comparisons[e.arithmetic.Peek()]; ok {
+		e.arithmetic.Next()
+		right, err := e.arithmetic.Sum()
+		return truth(compare(left, right)), err
+	}
+	return left, nil
+}
+
+// names are looked up with value, anything else is a literal
+func (e *macroExpression) Operand(token string) (int, error) {
+	if unicode.IsLetter([]rune(token)[0]) && !strings.HasPrefix(token, "H'") {
+		if value, ok := e.value(token); ok {
+			return value, nil
+		}
+		return 0, errors.New("símbolo " + token + " sem valor conhecido")
+	}
+	value, err := parser.LiteralValue(token, 32)
+	return int(value), err
+}
+
+// parentheses may hold comparisons and logical operators too
+func (e *macroExpression) Group() (int, error) {
+	return e.expression()
+}
+
+func (e *macroExpression) Negate(value int) (int, error) {
+	return -value, nil
+}
+
+func (e *macroExpression) Add(left, right int) (int, error) {
+	return left + right, nil
+}
+
+func (e *macroExpression) Subtract(left, right int) (int, error) {
+	return left - right, nil
+}
+
+func (e *macroExpression) Multiply(left, right int) (int, error) {
+	return left * right, nil
+}
+
+func (e *macroExpression) Divide(left, right int) (int, error) {
+	if right == 0 {
+		return left, errors.New("divisão por zero em expressão")
+	}
+	return left / right, nil
+}
+
+func truth(condition bool) int {
+	if condition {
+		return 1
+	}
+	return 0
+}
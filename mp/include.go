@@ -0,0 +1,97 @@
+package mp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"saturn/shared"
+	"strings"
+)
+
+// INCLUDE 'file.asm' reads file.asm in place of the INCLUDE line. Macros
+// defined by it are available to the rest of the including file.
+func (macroProcessor *macroProcessor) include(label string, operands []string, masmaprg io.Writer) {
+	if label != "" {
+		macroProcessor.addError(shared.CodeInclude, errors.New("INCLUDE não aceita rótulo"))
+		return
+	}
+	if len(operands) != 1 {
+		macroProcessor.addError(shared.CodeInclude,
+			errors.New("INCLUDE espera exatamente um nome de arquivo"))
+		return
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(operands[0], "'"), "'")
+	if name == "" {
+		macroProcessor.addError(shared.CodeInclude, errors.New("nome de arquivo vazio em INCLUDE"))
+		return
+	}
+
+	path, err := macroProcessor.searchPath(name)
+	if err != nil {
+		macroProcessor.addError(shared.CodeInclude, err)
+		return
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		macroProcessor.addError(shared.CodeInclude, errors.New(name+" é um diretório"))
+		return
+	}
+
+	absolute := absolutePath(path)
+	for i, open := range macroProcessor.openFiles {
+		if open == absolute {
+			chain := []string{}
+			for _, file := range macroProcessor.openFiles[i:] {
+				chain = append(chain, filepath.Base(file))
+			}
+			chain = append(chain, filepath.Base(absolute))
+			macroProcessor.addError(shared.CodeInclude,
+				errors.New("inclusão circular: "+strings.Join(chain, " -> ")))
+			return
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		macroProcessor.addError(shared.CodeInclude, err)
+		return
+	}
+	macroProcessor.sources[path] = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+
+	macroProcessor.includes = append(macroProcessor.includes,
+		Inclusion{File: macroProcessor.fileName, Line: macroProcessor.lineCounter})
+	defer func() {
+		macroProcessor.includes = macroProcessor.includes[:len(macroProcessor.includes)-1]
+	}()
+
+	macroProcessor.process(path, bytes.NewReader(content), masmaprg)
+}
+
+// relative names are searched next to the file being read, then in the
+// include paths in order
+func (macroProcessor *macroProcessor) searchPath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+
+	directories := append([]string{filepath.Dir(macroProcessor.fileName)},
+		macroProcessor.options.IncludePaths...)
+	for _, directory := range directories {
+		path := filepath.Join(directory, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", errors.New(name + " não encontrado")
+}
+
+func absolutePath(path string) string {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return absolute
+}
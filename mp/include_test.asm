@@ -0,0 +1,6 @@
+* shared definitions come first
+ INCLUDE 'include_test_defs.asm'
+ INCLUDE LIBRARY.ASM
+ DOUBLE X
+ STOP
+X CONST 2
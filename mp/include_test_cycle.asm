@@ -0,0 +1,2 @@
+ INCLUDE 'include_test_cycle2.asm'
+ STOP
@@ -0,0 +1 @@
+ INCLUDE 'include_test_cycle.asm'
@@ -0,0 +1,7 @@
+ MACRO
+ DOUBLE &A
+ LOAD &A
+ ADD &A
+ MEND
+*
+TWO EQU 2
@@ -0,0 +1,95 @@
+package mp
+
+import (
+	"errors"
+	"fmt"
+	"saturn/shared"
+	"strings"
+)
+
+// limits used when Options leaves them at 0. Recursive macros must stop
+// themselves with AIF, these only catch the ones that don't.
+const (
+	defaultMaxExpansionDepth = 100
+	defaultMaxExpandedLines  = 100000
+)
+
+func (options Options) maxExpansionDepth() int {
+	if options.MaxExpansionDepth > 0 {
+		return options.MaxExpansionDepth
+	}
+	return defaultMaxExpansionDepth
+}
+
+func (options Options) maxExpandedLines() int {
+	if options.MaxExpandedLines > 0 {
+		return options.MaxExpandedLines
+	}
+	return defaultMaxExpandedLines
+}
+
+// checks the limits before expanding name, reporting whether it may be
+// expanded. Once a limit is reached the whole call from the source is
+// abandoned.
+func (macroProcessor *macroProcessor) withinExpansionLimits(name string) bool {
+	if len(macroProcessor.expansions) == 0 {
+		macroProcessor.expandedLines = 0
+		macroProcessor.expansionAborted = false
+	}
+	if macroProcessor.expansionAborted {
+		return false
+	}
+
+	limit := macroProcessor.options.maxExpansionDepth()
+	if len(macroProcessor.expansions) < limit {
+		return true
+	}
+
+	names := append(macroProcessor.expansionNames(), name)
+	message := fmt.Sprintf("limite de %d expansões aninhadas atingido", limit)
+	end := len(macroProcessor.expansions)
+	if start, stop := recursionCycle(names); stop > 0 {
+		message = fmt.Sprintf("chamada recursiva %s passou do limite de %d expansões aninhadas",
+			strings.Join(names[start:stop+1], " > "), limit)
+		end = stop
+	}
+	macroProcessor.abortExpansion(message)
+
+	// the backtrace up to the first time the cycle closes is enough
+	last := &macroProcessor.diagnostics[len(macroProcessor.diagnostics)-1]
+	last.Expansions = last.Expansions[:end]
+	return false
+}
+
+// counts a statement run by an expansion, reporting whether the call from
+// the source is still within its budget
+func (macroProcessor *macroProcessor) countExpandedLine() bool {
+	if macroProcessor.expansionAborted {
+		return false
+	}
+	macroProcessor.expandedLines++
+	if limit := macroProcessor.options.maxExpandedLines(); macroProcessor.expandedLines > limit {
+		macroProcessor.abortExpansion(fmt.Sprintf(
+			"expansão passou de %d linhas, verifique AIF, AGO e chamadas recursivas", limit))
+		return false
+	}
+	return true
+}
+
+func (macroProcessor *macroProcessor) abortExpansion(message string) {
+	macroProcessor.addError(shared.CodeMacro, errors.New(message))
+	macroProcessor.expansionAborted = true
+}
+
+// the first macro to call itself, directly or not: names[start] is the
+// same as names[stop]. stop is 0 if there is no cycle.
+func recursionCycle(names []string) (start, stop int) {
+	seen := map[string]int{}
+	for i, name := range names {
+		if first, ok := seen[name]; ok {
+			return first, i
+		}
+		seen[name] = i
+	}
+	return 0, 0
+}
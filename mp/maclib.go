@@ -0,0 +1,164 @@
+package mp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"saturn/parser"
+	"saturn/shared"
+	"sort"
+	"strings"
+)
+
+// where a macro of a library is defined
+type libraryMacro struct {
+	file string
+	line uint16 // line of its MACRO
+}
+
+// files in a library directory that may hold macros
+var libraryExtensions = map[string]bool{".ASM": true, ".MAC": true}
+
+// MACLIB 'path' makes the macros of a file, or of the .asm and .mac files of
+// a directory, available to the rest of the source. Relative paths are
+// searched like INCLUDE files.
+func (macroProcessor *macroProcessor) macroLibraryDirective(label string, operands []string) {
+	if label != "" {
+		macroProcessor.addError(shared.CodeMacroLibrary, errors.New("MACLIB não aceita rótulo"))
+		return
+	}
+	if len(operands) != 1 {
+		macroProcessor.addError(shared.CodeMacroLibrary,
+			errors.New("MACLIB espera exatamente um arquivo ou diretório"))
+		return
+	}
+
+	path, err := macroProcessor.searchPath(strings.Trim(operands[0], "'"))
+	if err != nil {
+		macroProcessor.addError(shared.CodeMacroLibrary, err)
+		return
+	}
+	macroProcessor.addError(shared.CodeMacroLibrary, macroProcessor.addMacroLibrary(path))
+}
+
+// indexes the macros of path, the first library to define a name wins
+func (macroProcessor *macroProcessor) addMacroLibrary(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		files = nil
+		for _, entry := range entries {
+			extension := strings.ToUpper(filepath.Ext(entry.Name()))
+			if !entry.IsDir() && libraryExtensions[extension] {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	for _, file := range files {
+		if err := macroProcessor.indexMacroLibrary(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (macroProcessor *macroProcessor) indexMacroLibrary(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var lineCounter, macroLine uint16
+	depth := 0
+	isPrototype := false
+	for scanner.Scan() {
+		lineCounter++
+		line, isComment, _ := parser.ReadLine(scanner)
+		if isComment {
+			continue
+		}
+
+		_, operation, _ := parser.MacroLine(line)
+		switch {
+		case isPrototype:
+			isPrototype = false
+			if depth == 1 {
+				macroProcessor.addLibraryMacro(operation, libraryMacro{file: path, line: macroLine})
+			}
+		case operation == "MACRO":
+			depth++
+			isPrototype = true
+			macroLine = lineCounter
+		case operation == "MEND" && depth > 0:
+			depth--
+		}
+	}
+	return scanner.Err()
+}
+
+func (macroProcessor *macroProcessor) addLibraryMacro(name string, definition libraryMacro) {
+	if previous, ok := macroProcessor.libraryMacros[name]; ok {
+		macroProcessor.diagnostics = append(macroProcessor.diagnostics, shared.Diagnostic{
+			File:     definition.file,
+			Line:     int(definition.line),
+			Severity: shared.Warning,
+			Code:     shared.CodeMacroRedefined,
+			Message: fmt.Sprintf("macro %s já definido em %s, esta definição é ignorada",
+				name, filepath.Base(previous.file))})
+		return
+	}
+	macroProcessor.libraryMacros[name] = definition
+}
+
+// reports whether name is a macro, defining it from a library the first
+// time it is used
+func (macroProcessor *macroProcessor) isMacro(name string) bool {
+	if _, ok := macroProcessor.macroDefinitiontable[name]; ok {
+		return true
+	}
+	definition, ok := macroProcessor.libraryMacros[name]
+	if !ok {
+		return false
+	}
+
+	// loaded once, even if the definition turns out to be wrong
+	delete(macroProcessor.libraryMacros, name)
+	macroProcessor.loadLibraryMacro(definition)
+	_, ok = macroProcessor.macroDefinitiontable[name]
+	return ok
+}
+
+func (macroProcessor *macroProcessor) loadLibraryMacro(definition libraryMacro) {
+	file, err := os.Open(definition.file)
+	if err != nil {
+		macroProcessor.addError(shared.CodeMacroLibrary, err)
+		return
+	}
+	defer file.Close()
+
+	previousFile, previousLine := macroProcessor.fileName, macroProcessor.lineCounter
+	macroProcessor.fileName, macroProcessor.lineCounter = definition.file, 0
+	defer func() {
+		macroProcessor.fileName, macroProcessor.lineCounter = previousFile, previousLine
+	}()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(macroProcessor.scanLines)
+	for macroProcessor.lineCounter < definition.line && scanner.Scan() {
+	}
+	macroProcessor.macroDefine(scanner)
+}
@@ -0,0 +1 @@
+ INCR X
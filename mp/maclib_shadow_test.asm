@@ -0,0 +1,7 @@
+ MACLIB 'maclib_test_lib/arith.mac'
+ MACRO
+ INCR &X
+ ADD &X
+ MEND
+*
+ TWICE Y
@@ -0,0 +1,15 @@
+ MACLIB 'maclib_test_lib'
+ MACRO
+ ZERO &X
+ SUB &X
+ MEND
+*
+ MACRO
+ ZERO &X
+ LOAD @0
+ STORE &X
+ MEND
+*
+ TWICE A
+ ZERO B
+ MACLIB 'nothing'
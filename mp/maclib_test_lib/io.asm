@@ -0,0 +1,8 @@
+ MACRO
+ SHOW &X
+ WRITE &X
+ MEND
+ MACRO
+ INCR &X
+ ADD @2
+ MEND
@@ -0,0 +1,23 @@
+DEBUG EQU 1
+ MACRO
+ TRACE &N
+ IF &N GT 1
+ WRITE @&N
+ ELSE
+ WRITE @0
+ ENDIF
+ IFDEF DEBUG
+ LOAD @&N
+ ENDIF
+ MEND
+*
+ MACRO
+ OPEN
+ IF 1
+ WRITE @9
+ MEND
+*
+ TRACE 2
+ TRACE 1
+ OPEN
+ STOP
@@ -0,0 +1,250 @@
+package mp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"saturn/parser"
+	"saturn/shared"
+	"strconv"
+	"strings"
+)
+
+// statements run while a macro is expanded, they are never written.
+// Sequence symbols (.NAME) in the label column mark where AIF and AGO
+// may jump to.
+var macroTimeOperations = map[string]bool{
+	"AIF": true, "AGO": true, "ANOP": true, "MEXIT": true,
+	"LCLA": true, "GBLA": true, "SETA": true,
+}
+
+var variableReference = regexp.MustCompile(`&[A-Za-z][A-Za-z0-9]*`)
+
+// &SYSNDX is the number of the expansion, different for every expansion of
+// the module, so labels like LOOP&SYSNDX don't clash. It has 4 digits to
+// fit symbols of up to 8 characters, so using it past expansion 9999 is an
+// error, even if the expansion limits allow more.
+const (
+	expansionIndexVariable = "&SYSNDX"
+	maxExpansionIndex      = 9999
+)
+
+// state of one expansion of a macro
+type expansionFrame struct {
+	index          int               // value of &SYSNDX
+	arguments      map[string]string // parameter name to argument
+	locals         map[string]int
+	globals        map[string]bool // names declared by GBLA in this expansion
+	sequenceLabels map[string]int  // index of the statement with each label
+}
+
+func (macroProcessor *macroProcessor) newExpansionFrame(
+	macro macro, arguments []string) *expansionFrame {
+
+	macroProcessor.expansionCount++
+	frame := &expansionFrame{
+		index:          macroProcessor.expansionCount,
+		arguments:      map[string]string{},
+		locals:         map[string]int{},
+		globals:        map[string]bool{},
+		sequenceLabels: sequenceLabels(macro.instructions),
+	}
+	for i, parameter := range macro.parameters {
+		if i < len(arguments) {
+			frame.arguments[parameter] = arguments[i]
+		}
+	}
+	return frame
+}
+
+// labels of the macro's own statements, not the ones of macros it defines
+func sequenceLabels(instructions macroInstructions) map[string]int {
+	labels := map[string]int{}
+	depth := 0
+	for idx, instruction := range instructions {
+		label, operation, _ := parser.MacroLine(instruction)
+		switch {
+		case operation == "MACRO":
+			depth++
+		case operation == "MEND" && depth > 0:
+			depth--
+		case depth == 0 && strings.HasPrefix(label, "."):
+			labels[label] = idx
+		}
+	}
+	return labels
+}
+
+// the value of a variable or the argument of a parameter, as text
+func (macroProcessor *macroProcessor) lookup(frame *expansionFrame, name string) (string, bool) {
+	if name == expansionIndexVariable {
+		if frame.index > maxExpansionIndex && !macroProcessor.indexOverflow {
+			macroProcessor.indexOverflow = true
+			macroProcessor.addError(shared.CodeMacro, fmt.Errorf(
+				"%s passou de %d expansões e não cabe mais em 4 dígitos",
+				expansionIndexVariable, maxExpansionIndex))
+		}
+		return fmt.Sprintf("%04d", frame.index), true
+	}
+	if frame.globals[name] {
+		return strconv.Itoa(macroProcessor.globals[name]), true
+	}
+	if value, ok := frame.locals[name]; ok {
+		return strconv.Itoa(value), true
+	}
+	argument, ok := frame.arguments[name]
+	return argument, ok
+}
+
+// replaces variables and parameters inside tokens, such as &I in TAB+&I
+func (macroProcessor *macroProcessor) substituteVariables(
+	frame *expansionFrame, label, operation *string, operands []string) {
+
+	replace := func(reference string) string {
+		if value, ok := macroProcessor.lookup(frame, reference); ok {
+			return value
+		}
+		return reference
+	}
+	*label = variableReference.ReplaceAllStringFunc(*label, replace)
+	*operation = variableReference.ReplaceAllStringFunc(*operation, replace)
+	for i := range operands {
+		operands[i] = variableReference.ReplaceAllStringFunc(operands[i], replace)
+	}
+}
+
+// evaluates a SETA or AIF expression, where every &NAME must be known
+func (macroProcessor *macroProcessor) evaluateMacroExpression(
+	frame *expansionFrame, expression string) (int, error) {
+
+	var unknown error
+	expression = variableReference.ReplaceAllStringFunc(expression, func(reference string) string {
+		value, ok := macroProcessor.lookup(frame, reference)
+		if !ok && unknown == nil {
+			unknown = errors.New("variável " + reference + " não declarada")
+		}
+		return value
+	})
+	if unknown != nil {
+		return 0, unknown
+	}
+	return evaluate(expression, macroProcessor.symbolValue)
+}
+
+// runs a macro-time statement, returning the index of the next statement
+// or -1 to end the expansion
+func (macroProcessor *macroProcessor) macroTimeStatement(frame *expansionFrame,
+	idx int, label, operation string, operands []string) int {
+
+	switch operation {
+	case "LCLA", "GBLA":
+		for _, operand := range operands {
+			if operand == expansionIndexVariable {
+				macroProcessor.addError(shared.CodeMacro,
+					errors.New(operand+" não pode ser declarada"))
+				continue
+			}
+			if variableReference.FindString(operand) != operand {
+				macroProcessor.addError(shared.CodeMacro,
+					errors.New("nome de variável "+operand+" inválido"))
+				continue
+			}
+			if operation == "LCLA" {
+				frame.locals[operand] = 0
+			} else {
+				frame.globals[operand] = true
+			}
+		}
+
+	case "SETA":
+		if !strings.HasPrefix(label, "&") {
+			macroProcessor.addError(shared.CodeMacro,
+				errors.New("SETA precisa de uma variável no rótulo"))
+			break
+		}
+		if label == expansionIndexVariable {
+			macroProcessor.addError(shared.CodeMacro,
+				errors.New(label+" não pode ser alterada"))
+			break
+		}
+		value, err := evaluateWords(operands, func(expression string) (int, error) {
+			return macroProcessor.evaluateMacroExpression(frame, expression)
+		})
+		if err != nil {
+			macroProcessor.addError(shared.CodeMacro, err)
+			break
+		}
+		// variables that were not declared are local
+		if frame.globals[label] {
+			macroProcessor.globals[label] = value
+		} else {
+			frame.locals[label] = value
+		}
+
+	case "AIF":
+		condition, target, err := splitAIF(strings.Join(operands, " "))
+		if err != nil {
+			macroProcessor.addError(shared.CodeMacro, err)
+			break
+		}
+		value, err := macroProcessor.evaluateMacroExpression(frame, condition)
+		if err != nil {
+			macroProcessor.addError(shared.CodeMacro, err)
+			break
+		}
+		if value != 0 {
+			return macroProcessor.jump(frame, idx, target)
+		}
+
+	case "AGO":
+		if len(operands) != 1 {
+			macroProcessor.addError(shared.CodeMacro,
+				errors.New("AGO espera um símbolo de sequência"))
+			break
+		}
+		return macroProcessor.jump(frame, idx, operands[0])
+
+	case "MEXIT":
+		return -1
+	}
+
+	// ANOP only holds a sequence symbol
+	return idx + 1
+}
+
+func (macroProcessor *macroProcessor) jump(frame *expansionFrame, idx int, target string) int {
+	if destination, ok := frame.sequenceLabels[target]; ok {
+		return destination
+	}
+	macroProcessor.addError(shared.CodeMacro,
+		errors.New("símbolo de sequência "+target+" não definido"))
+	return idx + 1
+}
+
+// AIF (condition).LABEL
+func splitAIF(operand string) (condition, target string, err error) {
+	invalid := errors.New("AIF espera (condição).ROTULO")
+	if !strings.HasPrefix(operand, "(") {
+		return "", "", invalid
+	}
+
+	// the condition ends at the parenthesis that closes the first one, the
+	// target at the next space, and a comment may follow
+	depth := 0
+	closing := strings.IndexFunc(operand, func(r rune) bool {
+		if r == '(' {
+			depth++
+		} else if r == ')' {
+			depth--
+		}
+		return depth == 0
+	})
+	if closing < 0 || !strings.HasPrefix(operand[closing+1:], ".") {
+		return "", "", invalid
+	}
+	target, comment, _ := strings.Cut(operand[closing+1:], " ")
+	if comment = strings.TrimSpace(comment); comment != "" && !strings.HasPrefix(comment, "*") {
+		return "", "", invalid
+	}
+	return operand[:closing+1], target, nil
+}
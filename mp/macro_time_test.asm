@@ -0,0 +1,70 @@
+ MACRO
+ TABLE &N
+ LCLA &I
+&I SETA 1
+.LOOP AIF (&I GT &N).DONE
+ WRITE @&I
+&I SETA &I+1
+ AGO .LOOP
+.DONE ANOP
+ MEND
+*
+ MACRO
+ COUNT
+ GBLA &C
+&C SETA &C+1
+ WRITE @&C
+ MEND
+*
+ MACRO
+ PICK &X
+ AIF (&X EQ 0).ZERO
+ LOAD @&X
+ MEXIT
+.ZERO SUB ACC
+ MEND
+*
+ MACRO
+ FOREVER
+.AGAIN AGO .AGAIN
+ MEND
+*
+ MACRO
+ WRONG
+ AGO .NOWHERE
+&Y SETA &Z+1
+ MEND
+*
+ TABLE 3
+ COUNT
+ COUNT
+ PICK 0
+ PICK 5
+ FOREVER
+ WRONG
+ SETA 1
+*
+ MACRO
+ SQUARE &N
+&S SETA &N * &N
+ AIF (&S GT 2 * 5).BIG
+ WRITE @&S
+ MEXIT
+.BIG WRITE @0
+ MEND
+*
+ SQUARE 3
+ SQUARE 4
+*
+ MACRO
+ STEP &N
+ LCLA &I
+&I SETA &N + 1 * next
+ AIF (&I GT 2).BIG * jump when big
+ WRITE @&I
+ MEXIT
+.BIG WRITE @0
+ MEND
+*
+ STEP 1
+ STEP 5
@@ -5,79 +5,297 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"path/filepath"
 	"saturn/parser"
 	"saturn/shared"
 	"slices"
+	"strings"
 )
 
+// operations handled by the macro processor, they never reach the assembler
+var directives = map[string]bool{
+	"MACRO": true, "MEND": true, "INCLUDE": true, "MACLIB": true,
+	"IF": true, "IFDEF": true, "IFNDEF": true, "ELSE": true, "ENDIF": true,
+	"AIF": true, "AGO": true, "ANOP": true, "MEXIT": true,
+	"LCLA": true, "GBLA": true, "SETA": true,
+}
+
+// reports whether token is a macro processor directive
+func IsDirective(token string) bool {
+	return directives[token]
+}
+
 type macroInstructions []string
 type macro struct {
+	file               string   // where it was defined
+	lines              []uint16 // line of each instruction in file
 	numberOfParameters int
+	parameters         []string          // names as in the definition, for macro-time expressions
+	labelParameter     bool              // whether the first parameter is in the label column
+	defaults           map[string]string // keyword parameters and their defaults
 	instructions       macroInstructions
 }
 
+// where a line of the expanded source came from. Lines produced by a macro
+// expansion come from the line that called the outermost macro.
+type Origin struct {
+	File       string
+	Line       uint16
+	Macros     []string           // macros being expanded, outermost first
+	Expansions []shared.Expansion // the same macros and where in their bodies
+	Includes   []Inclusion        // INCLUDE lines that led to File, outermost first
+}
+
+// an INCLUDE line
+type Inclusion struct {
+	File string
+	Line uint16
+}
+
+// settings shared by every file of a build
+type Options struct {
+	// directories searched for INCLUDE files after the one of the file
+	// with the INCLUDE
+	IncludePaths []string
+	// symbols for IF and IFDEF, as given by -D NAME=VALUE
+	Defines map[string]int
+	// files or directories with macros, as given by -maclib
+	MacroLibraries []string
+	// macros expanded inside each other at most, 0 for the default
+	MaxExpansionDepth int
+	// lines a macro call in the source may expand to, counting AIF, AGO and
+	// other macro-time statements, 0 for the default
+	MaxExpandedLines int
+}
+
 type macroProcessor struct {
 	macroDefinitiontable map[string]macro
+	lineCounter          uint16
+	origins              []Origin           // origin of each line of the expanded source
+	expansions           []shared.Expansion // macros being expanded right now
+	fileName             string
+	includes             []Inclusion
+	sources              map[string][]string // lines of the files read by INCLUDE
+	openFiles            []string            // absolute paths of the files being read
+	conditionals         []conditional
+	fileConditionals     int // blocks opened before the current file or expansion
+	symbols              map[string]int
+	labels               map[string]bool
+	globals              map[string]int          // GBLA variables
+	expansionCount       int                     // for &SYSNDX
+	indexOverflow        bool                    // &SYSNDX passed 9999, already reported
+	libraryMacros        map[string]libraryMacro // macros not loaded yet
+	expandedLines        int                     // by the current call in the source
+	expansionAborted     bool                    // a limit was reached in the current call
+	options              Options
+	diagnostics          []shared.Diagnostic
 }
 
 func New() *macroProcessor {
+	return NewWithOptions(Options{})
+}
+
+func NewWithOptions(options Options) *macroProcessor {
 	macroProcessor := new(macroProcessor)
 	macroProcessor.macroDefinitiontable = map[string]macro{}
+	macroProcessor.options = options
+	macroProcessor.symbols = map[string]int{}
+	for name, value := range options.Defines {
+		macroProcessor.symbols[name] = value
+	}
+	macroProcessor.labels = map[string]bool{}
+	macroProcessor.globals = map[string]int{}
+	macroProcessor.sources = map[string][]string{}
+	macroProcessor.libraryMacros = map[string]libraryMacro{}
+	for _, library := range options.MacroLibraries {
+		if err := macroProcessor.addMacroLibrary(library); err != nil {
+			macroProcessor.diagnostics = append(macroProcessor.diagnostics, shared.Diagnostic{
+				File:     library,
+				Severity: shared.Error,
+				Code:     shared.CodeMacroLibrary,
+				Message:  err.Error()})
+		}
+	}
 	return macroProcessor
 }
 
-func (macroProcessor *macroProcessor) MacroPass(file *os.File) *os.File {
-	scanner := bufio.NewScanner(file)
+// Expand returns source with its macros and includes expanded, the text the
+// assembler reads and keeps as MASMAPRG_NAME.ASM. fileName is used in diagnostics
+// and to find the files source includes, which are still read from disk.
+func (macroProcessor *macroProcessor) Expand(fileName string, source io.Reader) string {
+	var expanded strings.Builder
+	macroProcessor.process(fileName, source, &expanded)
+	return expanded.String()
+}
 
-	masmaprg, err := shared.CreateBuildFile("MASMAPRG.ASM")
-	if err != nil {
-		panic(err)
-	}
+// writes the lines of source to masmaprg, expanding macros and includes
+func (macroProcessor *macroProcessor) process(fileName string, source io.Reader, masmaprg io.Writer) {
+	previousFile, previousLine := macroProcessor.fileName, macroProcessor.lineCounter
+	previousConditionals := macroProcessor.fileConditionals
+	macroProcessor.fileName, macroProcessor.lineCounter = fileName, 0
+	macroProcessor.fileConditionals = len(macroProcessor.conditionals)
+	macroProcessor.openFiles = append(macroProcessor.openFiles, absolutePath(fileName))
+	defer func() {
+		macroProcessor.closeConditionals()
+		macroProcessor.fileName, macroProcessor.lineCounter = previousFile, previousLine
+		macroProcessor.fileConditionals = previousConditionals
+		macroProcessor.openFiles = macroProcessor.openFiles[:len(macroProcessor.openFiles)-1]
+	}()
+
+	scanner := bufio.NewScanner(source)
+	scanner.Split(macroProcessor.scanLines)
 
 	for scanner.Scan() {
-		line, isComment := parser.ReadLine(scanner)
+		line, isComment, err := parser.ReadLine(scanner)
+		macroProcessor.addError(shared.CodeLineFormat, err)
 		if isComment {
 			continue
 		}
 
-		label, operationString, operands := parser.MacroLine(line)
+		label, operationString, operands := splitLine(line)
+
+		if macroProcessor.conditionalDirective(label, operationString, operands) ||
+			macroProcessor.skipping() {
+			continue
+		}
 
 		if operationString == "MACRO" {
 			macroProcessor.macroDefine(scanner)
 			continue
 
-		} else if _, ok := macroProcessor.macroDefinitiontable[operationString]; ok {
+		} else if operationString == "INCLUDE" {
+			macroProcessor.include(label, operands, masmaprg)
+			continue
+
+		} else if operationString == "MACLIB" {
+			macroProcessor.macroLibraryDirective(label, operands)
+			continue
+
+		} else if macroTimeOperations[operationString] {
+			macroProcessor.addError(shared.CodeMacro,
+				errors.New(operationString+" só pode ser usado dentro de macros"))
+			continue
+
+		} else if macroProcessor.isMacro(operationString) {
 			macroProcessor.macroExpand(line, masmaprg)
 			continue
 		}
 
+		macroProcessor.recordSymbol(label, operationString, operands)
+
 		// write line to file:
 		var operandsString string
 		for i := range operands {
 			operandsString += operands[i] + " "
 		}
-		writtenLine := fmt.Sprintln(label, operationString, operandsString)
-		masmaprg.WriteString(writtenLine)
+		writtenLine := label + " " + operationString + " " + operandsString
+		macroProcessor.writeLine(masmaprg, writtenLine)
+	}
+}
+
+// Origins maps each line of the expanded source (index 0 is line 1) to
+// where it came from in the original source
+func (macroProcessor *macroProcessor) Origins() []Origin {
+	return macroProcessor.origins
+}
+
+// Sources returns the lines of the files read by INCLUDE, by the name
+// Origin.File gives them
+func (macroProcessor *macroProcessor) Sources() map[string][]string {
+	return macroProcessor.sources
+}
+
+// Diagnostics returns the problems found in the source so far
+func (macroProcessor *macroProcessor) Diagnostics() []shared.Diagnostic {
+	return macroProcessor.diagnostics
+}
+
+// records err, if any, at the line being read
+func (macroProcessor *macroProcessor) addError(code string, err error) {
+	macroProcessor.addDiagnostic(shared.Error, code, err)
+}
+
+func (macroProcessor *macroProcessor) addWarning(code string, err error) {
+	macroProcessor.addDiagnostic(shared.Warning, code, err)
+}
+
+func (macroProcessor *macroProcessor) addDiagnostic(severity shared.Severity, code string, err error) {
+	if err == nil {
+		return
 	}
 
-	return masmaprg
+	column := 0
+	var lineErr *parser.LineError
+	if errors.As(err, &lineErr) {
+		column = lineErr.Column
+	}
+	macroProcessor.diagnostics = append(macroProcessor.diagnostics, shared.Diagnostic{
+		File:       macroProcessor.fileName,
+		Line:       int(macroProcessor.lineCounter),
+		Column:     column,
+		Severity:   severity,
+		Code:       code,
+		Message:    err.Error(),
+		Expansions: macroProcessor.backtrace()})
+}
+
+// the macros being expanded, nil outside expansions
+func (macroProcessor *macroProcessor) backtrace() []shared.Expansion {
+	if len(macroProcessor.expansions) == 0 {
+		return nil
+	}
+	return slices.Clone(macroProcessor.expansions)
+}
+
+func (macroProcessor *macroProcessor) expansionNames() []string {
+	var names []string
+	for _, expansion := range macroProcessor.expansions {
+		names = append(names, expansion.Macro)
+	}
+	return names
+}
+
+// no scanning happens during an expansion, so lineCounter still points to
+// the line that invoked the macro
+func (macroProcessor *macroProcessor) writeLine(masmaprg io.Writer, line string) {
+	io.WriteString(masmaprg, line+"\n")
+	macroProcessor.origins = append(macroProcessor.origins, Origin{
+		File:       macroProcessor.fileName,
+		Line:       macroProcessor.lineCounter,
+		Macros:     macroProcessor.expansionNames(),
+		Expansions: macroProcessor.backtrace(),
+		Includes:   slices.Clone(macroProcessor.includes)})
+}
+
+// bufio.ScanLines that also counts lines, including the ones consumed by macroDefine
+func (macroProcessor *macroProcessor) scanLines(
+	data []byte, atEOF bool) (advance int, token []byte, err error) {
+
+	advance, token, err = bufio.ScanLines(data, atEOF)
+	if token != nil {
+		macroProcessor.lineCounter++
+	}
+	return advance, token, err
 }
 
 // gets the macro definition, starts after "MACRO" operation/instruction
 func (macroProcessor *macroProcessor) macroDefine(scanner *bufio.Scanner) {
 
 	var macro macro
+	macro.file = macroProcessor.fileName
 	var macroName string
 	var macroOperands []string
 	isDefinition := true // first line after MACRO
 	quit := false
 	definitionLevel := 1
 	isFirstDefinition := true
+	var prototypeLine uint16
 	parameterStack := [][2]string{}
-	for scanner.Scan() && !quit {
+	for !quit && scanner.Scan() {
 
-		line, isComment := parser.ReadLine(scanner)
+		line, isComment, err := parser.ReadLine(scanner)
+		macroProcessor.addError(shared.CodeLineFormat, err)
 		if isComment {
 			continue
 		}
@@ -89,24 +307,26 @@ func (macroProcessor *macroProcessor) macroDefine(scanner *bufio.Scanner) {
 			if operand0 != "" {
 				macroOperands = slices.Insert(macroOperands, 0, operand0)
 			}
-			err := checkMacroOperands(macroOperands)
-			if err != nil {
-				panic(err)
-			}
-			parameterStack = addToStack(parameterStack, definitionLevel, macroOperands)
+			macroProcessor.addError(shared.CodeMacro, checkMacroOperands(macroOperands))
+			names, defaults := splitParameters(macroOperands)
+			parameterStack = addToStack(parameterStack, definitionLevel, names)
 
 			isDefinition = false
 
 			if isFirstDefinition {
 				macroName = currentName
-				macro.numberOfParameters = len(macroOperands)
+				macro.numberOfParameters = len(names)
+				macro.parameters = names
+				macro.labelParameter = operand0 != ""
+				macro.defaults = defaults
 				isFirstDefinition = false
+				prototypeLine = macroProcessor.lineCounter
 				continue
 			}
 
 		}
 
-		label, operationString, lineOperands := parser.MacroLine(line)
+		label, operationString, lineOperands := splitLine(line)
 		if operationString == "MACRO" {
 			definitionLevel++
 			isDefinition = true
@@ -123,22 +343,54 @@ func (macroProcessor *macroProcessor) macroDefine(scanner *bufio.Scanner) {
 
 		macroLine := createMacroLine(label, operationString, lineOperands)
 		macro.instructions = append(macro.instructions, macroLine)
+		macro.lines = append(macro.lines, macroProcessor.lineCounter)
 
 	}
 
 	if quit {
+		if _, ok := macroProcessor.macroDefinitiontable[macroName]; ok {
+			macroProcessor.diagnostics = append(macroProcessor.diagnostics, shared.Diagnostic{
+				File:     macroProcessor.fileName,
+				Line:     int(prototypeLine),
+				Severity: shared.Warning,
+				Code:     shared.CodeMacroRedefined,
+				Message:  "macro " + macroName + " redefinido"})
+		} else if library, ok := macroProcessor.libraryMacros[macroName]; ok {
+			// the source wins, the library definition is never loaded
+			delete(macroProcessor.libraryMacros, macroName)
+			macroProcessor.diagnostics = append(macroProcessor.diagnostics, shared.Diagnostic{
+				File:     macroProcessor.fileName,
+				Line:     int(prototypeLine),
+				Severity: shared.Warning,
+				Code:     shared.CodeMacroRedefined,
+				Message: fmt.Sprintf("macro %s esconde o definido em %s",
+					macroName, filepath.Base(library.file))})
+		}
 		macroProcessor.macroDefinitiontable[macroName] = macro
 	} else {
-		panic("faltando diretiva MEND")
+		line := prototypeLine
+		if line == 0 {
+			line = macroProcessor.lineCounter
+		}
+		macroProcessor.diagnostics = append(macroProcessor.diagnostics, shared.Diagnostic{
+			File:     macroProcessor.fileName,
+			Line:     int(line),
+			Severity: shared.Error,
+			Code:     shared.CodeMacro,
+			Message:  "faltando MEND para o macro " + macroName})
 	}
 
 }
 
+// lines has the line of each instruction in file
 func (macroProcessor *macroProcessor) macroDefineFromSlice(
 	macroInstructions []string,
+	lines []uint16,
+	file string,
 	parameterStack [][2]string) int {
 
 	var macro macro
+	macro.file = file
 	var macroName string
 	var macroOperands []string
 	isDefinition := true // first line after MACRO
@@ -163,21 +415,25 @@ func (macroProcessor *macroProcessor) macroDefineFromSlice(
 			}
 			// doesnt check if parameters start with & because our internal representation
 			// doesnt use &
-
-			parameterStack = addToStack(parameterStack, definitionLevel, macroOperands)
+			// keyword parameters keep their names, so calls can refer to them
+			names, defaults := splitParameters(macroOperands)
+			parameterStack = addToStack(parameterStack, definitionLevel, names)
 
 			isDefinition = false
 
 			if isFirstDefinition {
 				macroName = currentName
-				macro.numberOfParameters = len(macroOperands)
+				macro.numberOfParameters = len(names)
+				macro.parameters = names
+				macro.labelParameter = operand0 != ""
+				macro.defaults = defaults
 				isFirstDefinition = false
 				continue
 			}
 
 		}
 
-		label, operationString, lineOperands := parser.MacroLine(line)
+		label, operationString, lineOperands := splitLine(line)
 		if operationString == "MACRO" {
 			definitionLevel++
 			isDefinition = true
@@ -194,54 +450,121 @@ func (macroProcessor *macroProcessor) macroDefineFromSlice(
 
 		macroLine := createMacroLine(label, operationString, lineOperands)
 		macro.instructions = append(macro.instructions, macroLine)
+		if idx < len(lines) {
+			macro.lines = append(macro.lines, lines[idx])
+		}
 
 	}
 
-	if quit {
-		macroProcessor.macroDefinitiontable[macroName] = macro
-		return idx
-	} else {
-		panic("faltando diretiva MEND")
+	if !quit {
+		macroProcessor.addError(shared.CodeMacro,
+			errors.New("faltando MEND para o macro "+macroName))
+		return len(macroInstructions)
 	}
+	macroProcessor.macroDefinitiontable[macroName] = macro
+	return idx
 
 }
 
-func (macroProcessor *macroProcessor) macroExpand(line string, masmaprg *os.File) {
+func (macroProcessor *macroProcessor) macroExpand(line string, masmaprg io.Writer) {
 	operand0, name, operands := parser.MacroLine(line)
 	macro := macroProcessor.macroDefinitiontable[name]
-	if operand0 != "" {
-		operands = slices.Insert(operands, 0, operand0)
+	operands, missing, err := macro.bindArguments(name, operand0, operands)
+	if err != nil {
+		macroProcessor.addError(shared.CodeMacro, err)
+		return
+	}
+	for _, parameter := range missing {
+		macroProcessor.addWarning(shared.CodeMacro, errors.New("faltando argumento para "+
+			parameter+" na chamada de "+name+", use '' para deixá-lo vazio"))
 	}
-	if len(operands) > macro.numberOfParameters {
-		panic("um macro tem parametros demais")
+	if !macroProcessor.withinExpansionLimits(name) {
+		return
 	}
 
+	macroProcessor.expansions = append(macroProcessor.expansions,
+		shared.Expansion{Macro: name, File: macro.file})
+	// nested expansions may move the slice, so it is indexed every time
+	depth := len(macroProcessor.expansions) - 1
+	defer func() {
+		macroProcessor.expansions = macroProcessor.expansions[:len(macroProcessor.expansions)-1]
+	}()
+
+	previousConditionals := macroProcessor.fileConditionals
+	macroProcessor.fileConditionals = len(macroProcessor.conditionals)
+	defer func() {
+		macroProcessor.closeExpansionConditionals(name)
+		macroProcessor.fileConditionals = previousConditionals
+	}()
+
 	parameterStack := [][2]string{}
 	parameterStack = addToStack(parameterStack, 1, operands)
+	frame := macroProcessor.newExpansionFrame(macro, operands)
 
 	// substitutes things like #1 #2 for arg1 arg2
 	for idx := 0; idx < len(macro.instructions); idx++ {
+		if idx < len(macro.lines) {
+			macroProcessor.expansions[depth].Line = int(macro.lines[idx])
+		}
+		if !macroProcessor.countExpandedLine() {
+			return
+		}
+
 		instructionLine := macro.instructions[idx]
-		label, operationString, operands := parser.MacroLine(instructionLine)
+		label, operationString, operands := splitLine(instructionLine)
 		replaceCodesByNames(parameterStack, &label, &operationString, operands)
+
+		if macroTimeOperations[operationString] {
+			if macroProcessor.skipping() {
+				continue
+			}
+			next := macroProcessor.macroTimeStatement(frame, idx, label, operationString, operands)
+			if next < 0 {
+				return
+			}
+			idx = next - 1
+			continue
+		}
+		if strings.HasPrefix(label, ".") {
+			label = ""
+		}
+		macroProcessor.substituteVariables(frame, &label, &operationString, operands)
 		removeAmpersands(&label, &operationString, operands)
 
+		// IF blocks in the body are decided again for every expansion
+		if macroProcessor.conditionalDirective(label, operationString, operands) ||
+			macroProcessor.skipping() {
+			continue
+		}
+
 		macroLine := createMacroLine(label, operationString, operands)
 
-		if _, isMacro := macroProcessor.macroDefinitiontable[operationString]; isMacro {
+		if macroProcessor.isMacro(operationString) {
 			macroProcessor.macroExpand(macroLine, masmaprg)
 			continue
 		}
 		if operationString == "MACRO" {
-			idx += macroProcessor.macroDefineFromSlice(macro.instructions[idx+1:], parameterStack)
+			idx += macroProcessor.macroDefineFromSlice(macro.instructions[idx+1:],
+				macro.lines[min(idx+1, len(macro.lines)):], macro.file, parameterStack)
 			continue
 		}
 		if operationString == "MEND" {
 			return
 		}
 
-		masmaprg.WriteString(macroLine + "\n")
+		macroProcessor.writeLine(masmaprg, macroLine)
+	}
+}
+
+// splits a source line. The operands of IF, SETA and AIF are one expression,
+// where a spaced "*" may be multiplication, so a comment after them is kept
+// until the expression is evaluated, see evaluateWords
+func splitLine(line string) (label, operation string, operands []string) {
+	label, operation, operands = parser.MacroLine(line)
+	if operation == "IF" || operation == "SETA" || operation == "AIF" {
+		return parser.ExpressionLine(line)
 	}
+	return label, operation, operands
 }
 
 func createMacroLine(label, operation string, operands []string) string {
@@ -343,11 +666,11 @@ func removeAmpersands(label, operation *string, operands []string) {
 			*label = (*label)[1:]
 		}
 	}
-	if (*operation)[0] == '&' {
+	if len(*operation) > 0 && (*operation)[0] == '&' {
 		*operation = (*operation)[1:]
 	}
 	for i := range operands {
-		if operands[i][0] == '&' {
+		if len(operands[i]) > 0 && operands[i][0] == '&' {
 			operands[i] = operands[i][1:]
 		}
 	}
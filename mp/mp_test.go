@@ -4,6 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
+	"saturn/parser"
+	"saturn/shared"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -86,7 +91,9 @@ func TestMacroExpand(t *testing.T) {
 	scanner := bufio.NewScanner(file)
 	scanner.Scan()          // skips first MACRO line
 	mp.macroDefine(scanner) // defines C
+	scanner.Scan()
 	mp.macroDefine(scanner) // defines A
+	scanner.Scan()
 	mp.macroDefine(scanner) // defines B
 
 	write_file, err := os.Create("macro_expansion")
@@ -117,6 +124,17 @@ func TestMacroExpand(t *testing.T) {
 
 }
 
+func TestLineAfterMend(t *testing.T) {
+	// the call right after MEND is not part of the definition
+	mp := New()
+	expanded := mp.Expand("mend.asm", strings.NewReader(" MACRO\n ONE\n LOAD @1\n MEND\n ONE\n STOP\n"))
+	written := strings.Fields(expanded)
+	goal := []string{"LOAD", "@1", "STOP"}
+	if !slices.Equal(written, goal) || len(mp.Diagnostics()) != 0 {
+		t.Fatalf("esperava-se %v, obteve-se %v %v", goal, written, mp.Diagnostics())
+	}
+}
+
 func TestMacroPass(t *testing.T) {
 	mp := New()
 	file, err := os.Open("macro_pass_test.asm")
@@ -125,5 +143,475 @@ func TestMacroPass(t *testing.T) {
 	}
 	defer file.Close()
 
-	mp.MacroPass(file)
+	mp.Expand(file.Name(), file)
+}
+
+func TestInclude(t *testing.T) {
+	mp := NewWithOptions(Options{IncludePaths: []string{"include_test_lib"}})
+	file, err := os.Open("include_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	mp.Expand(file.Name(), file)
+
+	if len(mp.Diagnostics()) != 0 {
+		t.Fatalf("erros inesperados: %v", mp.Diagnostics())
+	}
+
+	// TWO EQU 2, ONE EQU 1, the expansion of DOUBLE, then STOP and X
+	goal := []struct {
+		file   string
+		line   uint16
+		macros int
+		from   uint16 // line of the outermost INCLUDE, 0 if not included
+	}{
+		{"include_test_defs.asm", 7, 0, 2},
+		{"include_test_lib/LIBRARY.ASM", 1, 0, 3},
+		{"include_test.asm", 4, 1, 0},
+		{"include_test.asm", 4, 1, 0},
+		{"include_test.asm", 5, 0, 0},
+		{"include_test.asm", 6, 0, 0},
+	}
+	origins := mp.Origins()
+	if len(origins) != len(goal) {
+		t.Fatalf("esperava-se %d linhas, obteve-se %+v", len(goal), origins)
+	}
+	for i, origin := range origins {
+		from := uint16(0)
+		if len(origin.Includes) != 0 {
+			from = origin.Includes[0].Line
+		}
+		if origin.File != goal[i].file || origin.Line != goal[i].line ||
+			len(origin.Macros) != goal[i].macros || from != goal[i].from {
+			t.Fatalf("linha %d: esperava-se %+v, obteve-se %+v", i+1, goal[i], origin)
+		}
+	}
+
+	// the assembler shows included lines from Sources, not from disk
+	if text := mp.Sources()["include_test_defs.asm"][6]; text != "TWO EQU 2" {
+		t.Fatalf("esperava-se TWO EQU 2, obteve-se %q", text)
+	}
+}
+
+func TestCircularInclude(t *testing.T) {
+	mp := New()
+	file, err := os.Open("include_test_cycle.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	mp.Expand(file.Name(), file)
+
+	diagnostics := mp.Diagnostics()
+	if len(diagnostics) != 1 || diagnostics[0].File != "include_test_cycle2.asm" ||
+		diagnostics[0].Line != 1 {
+		t.Fatalf("esperava-se uma inclusão circular em include_test_cycle2.asm:1, obteve-se %v",
+			diagnostics)
+	}
+	if len(mp.Origins()) != 1 {
+		t.Fatalf("STOP deveria ser a única linha escrita, obteve-se %+v", mp.Origins())
+	}
+}
+
+// the numbers written by conditional_test.asm
+func conditionalOutput(t *testing.T, defines map[string]int) []string {
+	mp := NewWithOptions(Options{Defines: defines})
+	file, err := os.Open("conditional_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	expanded := mp.Expand(file.Name(), file)
+	if len(mp.Diagnostics()) != 0 {
+		t.Fatalf("erros inesperados: %v", mp.Diagnostics())
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(expanded))
+	var written []string
+	for scanner.Scan() {
+		label, operation, operands := parser.MacroLine(scanner.Text())
+		if label == "" && operation == "WRITE" {
+			written = append(written, operands[0])
+		}
+	}
+	return written
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []struct {
+		defines map[string]int
+		goal    []string
+	}{
+		{map[string]int{"DEBUG": 1, "VERBOSE": 0}, []string{"@1", "@2", "@6", "@7", "@9", "@10"}},
+		{map[string]int{"DEBUG": 1, "VERBOSE": 1}, []string{"@1", "@3", "@6", "@7", "@9", "@10"}},
+		{map[string]int{"DEBUG": 0, "RELEASE": 1}, []string{"@4", "@5", "@6", "@9"}},
+	}
+	for _, test := range tests {
+		written := conditionalOutput(t, test.defines)
+		if !slices.Equal(written, test.goal) {
+			t.Fatalf("com %v: esperava-se %v, obteve-se %v", test.defines, test.goal, written)
+		}
+	}
+}
+
+func TestConditionalErrors(t *testing.T) {
+	mp := New()
+	file, err := os.Open("conditional_errors_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	mp.Expand(file.Name(), file)
+
+	// ELSE without IF, unknown symbol, second ELSE and the IF never closed
+	var lines []int
+	for _, diagnostic := range mp.Diagnostics() {
+		if diagnostic.Code != shared.CodeConditional {
+			t.Fatalf("código inesperado: %v", diagnostic)
+		}
+		lines = append(lines, diagnostic.Line)
+	}
+	if !slices.Equal(lines, []int{1, 2, 6, 8}) {
+		t.Fatalf("esperava-se erros nas linhas 1, 2, 6 e 8, obteve-se %v", mp.Diagnostics())
+	}
+	if len(mp.Origins()) != 0 {
+		t.Fatalf("STOP está dentro de IF 0, obteve-se %+v", mp.Origins())
+	}
+}
+
+func TestConditionalsInMacros(t *testing.T) {
+	mp := New()
+	file, err := os.Open("macro_conditional_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	expanded := mp.Expand(file.Name(), file)
+
+	scanner := bufio.NewScanner(strings.NewReader(expanded))
+	var written []string
+	for scanner.Scan() {
+		written = append(written, strings.Join(strings.Fields(scanner.Text()), " "))
+	}
+	goal := []string{"DEBUG EQU 1", "WRITE @2", "LOAD @2", "WRITE @0", "LOAD @1",
+		"WRITE @9", "STOP"}
+	if !slices.Equal(written, goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, written)
+	}
+
+	// OPEN never closes its IF
+	diagnostics := mp.Diagnostics()
+	if len(diagnostics) != 1 || diagnostics[0].Code != shared.CodeConditional ||
+		diagnostics[0].Line != 22 {
+		t.Fatalf("esperava-se faltando ENDIF na linha 22, obteve-se %v", diagnostics)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	values := map[string]int{"A": 3, "B": 4}
+	value := func(name string) (int, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+
+	tests := map[string]int{
+		"A+B*2":             11,
+		"(A+B)*2":           14,
+		"-A+H'10'":          13,
+		"A LT B":            1,
+		"A EQ B OR B EQ 4":  1,
+		"NOT A GE B AND 1":  1,
+		"B/A NE 1":          0,
+		"A GT 1 AND B LE 3": 0,
+	}
+	for expression, goal := range tests {
+		result, err := evaluate(expression, value)
+		if err != nil || result != goal {
+			t.Fatalf("%s: esperava-se %d, obteve-se %d (%v)", expression, goal, result, err)
+		}
+	}
+
+	for _, expression := range []string{"A+", "C", "(A", "A/0", "A B"} {
+		if _, err := evaluate(expression, value); err == nil {
+			t.Fatalf("%s deveria ser um erro", expression)
+		}
+	}
+}
+
+func TestMacroTimeStatements(t *testing.T) {
+	mp := New()
+	file, err := os.Open("macro_time_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	expanded := mp.Expand(file.Name(), file)
+
+	scanner := bufio.NewScanner(strings.NewReader(expanded))
+	var written []string
+	for scanner.Scan() {
+		written = append(written, strings.Join(strings.Fields(scanner.Text()), " "))
+	}
+	goal := []string{"WRITE @1", "WRITE @2", "WRITE @3", "WRITE @1", "WRITE @2",
+		"SUB ACC", "LOAD @5", "WRITE @9", "WRITE @0", "WRITE @2", "WRITE @0"}
+	if !slices.Equal(written, goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, written)
+	}
+
+	// FOREVER never ends, WRONG jumps nowhere and uses an unknown variable,
+	// SETA is outside a macro
+	var lines []int
+	for _, diagnostic := range mp.Diagnostics() {
+		if diagnostic.Code != shared.CodeMacro {
+			t.Fatalf("código inesperado: %v", diagnostic)
+		}
+		lines = append(lines, diagnostic.Line)
+	}
+	if !slices.Equal(lines, []int{43, 44, 44, 45}) {
+		t.Fatalf("esperava-se erros nas linhas 43, 44, 44 e 45, obteve-se %v", mp.Diagnostics())
+	}
+}
+
+func TestExpansionIndex(t *testing.T) {
+	mp := New()
+	file, err := os.Open("sysndx_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	expanded := mp.Expand(file.Name(), file)
+	if len(mp.Diagnostics()) != 0 {
+		t.Fatalf("erros inesperados: %v", mp.Diagnostics())
+	}
+
+	// the inner expansions of TWICE get their own numbers, and TWICE keeps its
+	// own after them
+	scanner := bufio.NewScanner(strings.NewReader(expanded))
+	var labels []string
+	for scanner.Scan() {
+		label, operation, operands := parser.MacroLine(scanner.Text())
+		if label != "" {
+			labels = append(labels, label)
+		} else if operation == "BRPOS" || operation == "BRZERO" {
+			labels = append(labels, operation+" "+operands[0])
+		}
+	}
+	goal := []string{"L0001", "BRPOS L0001", "T0002", "L0003", "BRPOS L0003",
+		"L0004", "BRPOS L0004", "BRZERO T0002", "L0005", "BRPOS L0005"}
+	if !slices.Equal(labels, goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, labels)
+	}
+}
+
+func TestExpansionIndexOverflow(t *testing.T) {
+	mp := New()
+	mp.expansionCount = maxExpansionIndex - 1
+	file, err := os.Open("sysndx_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	// WAIT 2 is expansion 9999, TWICE 3 the first past it, reported once
+	mp.Expand(file.Name(), file)
+	diagnostics := mp.Diagnostics()
+	if len(diagnostics) != 1 || diagnostics[0].Code != shared.CodeMacro ||
+		diagnostics[0].Line != 17 {
+		t.Fatalf("esperava-se um erro na linha 17, obteve-se %v", diagnostics)
+	}
+}
+
+func TestMacroParameters(t *testing.T) {
+	mp := New()
+	file, err := os.Open("parameters_test.asm")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	expanded := mp.Expand(file.Name(), file)
+
+	scanner := bufio.NewScanner(strings.NewReader(expanded))
+	var written []string
+	for scanner.Scan() {
+		written = append(written, strings.Join(strings.Fields(scanner.Text()), " "))
+	}
+	goal := []string{
+		"ADD 2", "SUB 9", "ADD 3", "SUB 4",
+		"A LOAD X", "STORE Y", "WRITE ACC",
+		"LOAD X", "STORE Y", "WRITE B",
+		"LOAD X", "STORE", "WRITE C",
+		"LOAD X", "STORE", "WRITE ACC",
+	}
+	if !slices.Equal(written, goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, written)
+	}
+
+	// a warning for &TO left out, then too many arguments, unknown keyword,
+	// repeated keyword and a label for a macro without a label parameter.
+	// The '' on the last line leaves &TO empty on purpose.
+	var lines []int
+	for _, diagnostic := range mp.Diagnostics() {
+		if diagnostic.Code != shared.CodeMacro ||
+			(diagnostic.Severity == shared.Warning) != (diagnostic.Line == 22) {
+			t.Fatalf("diagnóstico inesperado: %v", diagnostic)
+		}
+		lines = append(lines, diagnostic.Line)
+	}
+	if !slices.Equal(lines, []int{22, 23, 24, 25, 26}) {
+		t.Fatalf("esperava-se diagnósticos nas linhas 22 a 26, obteve-se %v", mp.Diagnostics())
+	}
+}
+
+func TestRecursiveMacros(t *testing.T) {
+	// DOWN stops itself with AIF, PING and PONG call each other forever
+	mp := New()
+	written := macroPassOutput(mp, "recursion_test.asm")
+	goal := []string{"WRITE @3", "WRITE @2", "WRITE @1", "WRITE @1"}
+	if !slices.Equal(written, goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, written)
+	}
+	diagnostics := mp.Diagnostics()
+	if len(diagnostics) != 1 || diagnostics[0].Line != 22 ||
+		!strings.Contains(diagnostics[0].Message, "PING > PONG > PING") {
+		t.Fatalf("esperava-se um erro na linha 22 com o ciclo PING > PONG > PING, obteve-se %v",
+			diagnostics)
+	}
+	if backtrace := diagnostics[0].Backtrace(); backtrace !=
+		" em PING (recursion_test.asm:13) > PONG (recursion_test.asm:18)" {
+		t.Fatalf("backtrace inesperado: %q", backtrace)
+	}
+
+	// with smaller limits DOWN 3 stops halfway, DOWN 1 still fits
+	for _, options := range []Options{{MaxExpansionDepth: 2}, {MaxExpandedLines: 9}} {
+		mp := NewWithOptions(options)
+		written := macroPassOutput(mp, "recursion_test.asm")
+		goal := []string{"WRITE @3", "WRITE @2", "WRITE @1"}
+		if !slices.Equal(written, goal) {
+			t.Fatalf("%+v: esperava-se %v, obteve-se %v", options, goal, written)
+		}
+		var lines []int
+		for _, diagnostic := range mp.Diagnostics() {
+			lines = append(lines, diagnostic.Line)
+		}
+		if !slices.Equal(lines, []int{21, 22}) {
+			t.Fatalf("%+v: esperava-se erros nas linhas 21 e 22, obteve-se %v",
+				options, mp.Diagnostics())
+		}
+	}
+}
+
+// the lines written to MASMAPRG.ASM, with single spaces
+func macroPassOutput(mp *macroProcessor, fileName string) []string {
+	file, err := os.Open(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	expanded := mp.Expand(file.Name(), file)
+
+	scanner := bufio.NewScanner(strings.NewReader(expanded))
+	var written []string
+	for scanner.Scan() {
+		written = append(written, strings.Join(strings.Fields(scanner.Text()), " "))
+	}
+	return written
+}
+
+func TestMacroLibrary(t *testing.T) {
+	mp := New()
+	written := macroPassOutput(mp, "maclib_test.asm")
+
+	goal := []string{"LOAD A", "ADD @1", "STORE A", "LOAD A", "ADD @1", "STORE A",
+		"LOAD @0", "STORE B"}
+	if !slices.Equal(written, goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, written)
+	}
+	if _, ok := mp.macroDefinitiontable["SHOW"]; ok {
+		t.Fatal("SHOW não é usado e não deveria ter sido definido")
+	}
+
+	// INCR of io.asm loses to the one of arith.mac, ZERO is redefined and
+	// the second library doesn't exist
+	type place struct {
+		file     string
+		line     int
+		severity shared.Severity
+	}
+	var places []place
+	for _, diagnostic := range mp.Diagnostics() {
+		places = append(places, place{filepath.Base(diagnostic.File), diagnostic.Line,
+			diagnostic.Severity})
+	}
+	goalPlaces := []place{{"io.asm", 5, shared.Warning}, {"maclib_test.asm", 8, shared.Warning},
+		{"maclib_test.asm", 15, shared.Error}}
+	if !slices.Equal(places, goalPlaces) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goalPlaces, mp.Diagnostics())
+	}
+}
+
+func TestMacroLibraryOption(t *testing.T) {
+	mp := NewWithOptions(Options{MacroLibraries: []string{"maclib_test_lib/arith.mac"}})
+	written := macroPassOutput(mp, "maclib_option_test.asm")
+
+	goal := []string{"LOAD X", "ADD @1", "STORE X"}
+	if !slices.Equal(written, goal) || len(mp.Diagnostics()) != 0 {
+		t.Fatalf("esperava-se %v, obteve-se %v %v", goal, written, mp.Diagnostics())
+	}
+}
+
+func TestMacroLibraryShadowed(t *testing.T) {
+	mp := New()
+	written := macroPassOutput(mp, "maclib_shadow_test.asm")
+
+	// TWICE comes from the library but calls the INCR of the source
+	goal := []string{"ADD Y", "ADD Y"}
+	if !slices.Equal(written, goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, written)
+	}
+	diagnostics := mp.Diagnostics()
+	if len(diagnostics) != 1 || diagnostics[0].Line != 3 ||
+		diagnostics[0].Severity != shared.Warning {
+		t.Fatalf("esperava-se um aviso na linha 3, obteve-se %v", diagnostics)
+	}
+}
+
+func TestMacroBacktrace(t *testing.T) {
+	mp := New()
+	macroPassOutput(mp, "backtrace_test.asm")
+
+	diagnostics := mp.Diagnostics()
+	if len(diagnostics) != 3 {
+		t.Fatalf("esperava-se 3 erros, obteve-se %v", diagnostics)
+	}
+
+	// AGO .NOWHERE in INNER, called by OUTER, called by line 13
+	goal := []shared.Expansion{
+		{Macro: "OUTER", File: "backtrace_test.asm", Line: 10},
+		{Macro: "INNER", File: "backtrace_test.asm", Line: 4},
+	}
+	if diagnostics[0].Line != 13 || !slices.Equal(diagnostics[0].Expansions, goal) {
+		t.Fatalf("esperava-se a linha 13 em %v, obteve-se %v", goal, diagnostics[0])
+	}
+	if !strings.HasSuffix(diagnostics[0].String(),
+		" em OUTER (backtrace_test.asm:10) > INNER (backtrace_test.asm:4)") {
+		t.Fatalf("expansões faltando em %q", diagnostics[0].String())
+	}
+
+	// a parameter without & and a macro without MEND
+	if diagnostics[1].Line != 15 || diagnostics[1].Expansions != nil {
+		t.Fatalf("esperava-se um erro na linha 15, obteve-se %v", diagnostics[1])
+	}
+	if diagnostics[2].Line != 19 || !strings.Contains(diagnostics[2].Message, "MEND") {
+		t.Fatalf("esperava-se MEND faltando na linha 19, obteve-se %v", diagnostics[2])
+	}
 }
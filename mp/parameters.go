@@ -0,0 +1,110 @@
+package mp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parameters are positional (&A) or keyword (&REG=ACC). Keyword parameters
+// are given as REG=VALUE in the call and take their default otherwise.
+// Omitted positional parameters are empty, but worth a warning, as they are
+// usually a mistake: an argument meant to be empty is written ''.
+
+// splits &REG=ACC into the name &REG and its default
+func splitParameters(operands []string) (names []string, defaults map[string]string) {
+	defaults = map[string]string{}
+	for _, operand := range operands {
+		name, value, isKeyword := strings.Cut(operand, "=")
+		if isKeyword {
+			defaults[name] = value
+		}
+		names = append(names, name)
+	}
+	return names, defaults
+}
+
+func (macro macro) isKeyword(parameter string) bool {
+	_, ok := macro.defaults[parameter]
+	return ok
+}
+
+// lines the label and operands of a call up with the parameters of macro
+// name, one argument per parameter. missing holds the positional parameters
+// the call left out.
+func (macro macro) bindArguments(name, label string, operands []string) (
+	arguments []string, missing []string, err error) {
+
+	arguments = make([]string, len(macro.parameters))
+	given := make([]bool, len(macro.parameters))
+
+	next := 0 // next positional parameter
+	if macro.labelParameter {
+		arguments[0], given[0] = label, true
+		next = 1
+	} else if label != "" {
+		return nil, nil, fmt.Errorf("macro %s não aceita rótulo", name)
+	}
+
+	positional := 0
+	for _, parameter := range macro.parameters[next:] {
+		if !macro.isKeyword(parameter) {
+			positional++
+		}
+	}
+
+	for _, operand := range operands {
+		if keyword, value, isKeyword := strings.Cut(operand, "="); isKeyword {
+			parameter := "&" + strings.TrimPrefix(keyword, "&")
+			idx := indexOf(macro.parameters, parameter)
+			if idx < 0 || !macro.isKeyword(parameter) {
+				return nil, nil, fmt.Errorf("macro %s não tem parâmetro de palavra-chave %s",
+					name, keyword)
+			}
+			if given[idx] {
+				return nil, nil, fmt.Errorf("parâmetro %s repetido na chamada de %s",
+					keyword, name)
+			}
+			arguments[idx], given[idx] = argumentValue(value), true
+			continue
+		}
+
+		for next < len(macro.parameters) && macro.isKeyword(macro.parameters[next]) {
+			next++
+		}
+		if next == len(macro.parameters) {
+			return nil, nil, fmt.Errorf("macro %s espera no máximo %d argumentos posicionais",
+				name, positional)
+		}
+		arguments[next], given[next] = argumentValue(operand), true
+		next++
+	}
+
+	for idx, parameter := range macro.parameters {
+		if given[idx] {
+			continue
+		}
+		arguments[idx] = macro.defaults[parameter]
+		// a missing label is a call without one
+		if !macro.isKeyword(parameter) && !(idx == 0 && macro.labelParameter) {
+			missing = append(missing, parameter)
+		}
+	}
+	return arguments, missing, nil
+}
+
+// an argument written as two apostrophes is empty
+func argumentValue(operand string) string {
+	if operand == "''" {
+		return ""
+	}
+	return operand
+}
+
+func indexOf(names []string, name string) int {
+	for i, candidate := range names {
+		if candidate == name {
+			return i
+		}
+	}
+	return -1
+}
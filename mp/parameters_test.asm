@@ -0,0 +1,27 @@
+ MACRO
+&L MOVE &FROM &TO &REG=ACC &MODE=
+&L LOAD &FROM
+ STORE &TO
+ WRITE &REG
+ MEND
+*
+ MACRO
+ OUTER &X
+ MACRO
+ INNER &Y &Z=9
+ ADD &Y
+ SUB &Z
+ MEND
+ MEND
+*
+ OUTER 1
+ INNER 2
+ INNER 3 Z=4
+A MOVE X Y
+ MOVE X Y REG=B
+ MOVE X &REG=C
+ MOVE X Y Z
+ MOVE X Y FOO=1
+ MOVE X Y REG=1 REG=2
+B INNER 1
+ MOVE X ''
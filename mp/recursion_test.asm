@@ -0,0 +1,23 @@
+* recursive macros
+ MACRO
+ DOWN &N
+ AIF (&N EQ 0).DONE
+ WRITE @&N
+&M SETA &N-1
+ DOWN &M
+.DONE ANOP
+ MEND
+*
+ MACRO
+ PING
+ PONG
+ MEND
+*
+ MACRO
+ PONG
+ PING
+ MEND
+*
+ DOWN 3
+ PING
+ DOWN 1
@@ -0,0 +1,18 @@
+ MACRO
+ WAIT &N
+ LOAD @&N
+L&SYSNDX SUB @1
+ BRPOS L&SYSNDX
+ MEND
+*
+ MACRO
+ TWICE &N
+T&SYSNDX LOAD @&N
+ WAIT &N
+ WAIT &N
+ BRZERO T&SYSNDX
+ MEND
+*
+ WAIT 2
+ TWICE 3
+ WAIT 4
@@ -0,0 +1,126 @@
+package parser
+
+import "errors"
+
+// the values an Arithmetic computes with. The assembler keeps relocation
+// modes in them, the macro processor uses plain integers.
+type Values[V any] interface {
+	// a symbol or a literal
+	Operand(token string) (V, error)
+	// the expression between parentheses, whose grammar belongs to the caller
+	Group() (V, error)
+	Negate(value V) (V, error)
+	Add(left, right V) (V, error)
+	Subtract(left, right V) (V, error)
+	Multiply(left, right V) (V, error)
+	Divide(left, right V) (V, error)
+}
+
+// recursive descent over the arithmetic part of an expression, shared by
+// the assembler and the macro processor:
+//
+//	sum     := product {("+" | "-") product}
+//	product := factor {("*" | "/") factor}
+//	factor  := ("+" | "-") factor | "(" group ")" | operand
+type Arithmetic[V any] struct {
+	Tokens   []string
+	Position int
+	Values   Values[V]
+}
+
+// splits expression into the tokens values will be asked about
+func NewArithmetic[V any](expression string, values Values[V]) (*Arithmetic[V], error) {
+	tokens, err := ExpressionTokens(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &Arithmetic[V]{Tokens: tokens, Values: values}, nil
+}
+
+func (a *Arithmetic[V]) Peek() string {
+	if a.Position < len(a.Tokens) {
+		return a.Tokens[a.Position]
+	}
+	return EMPTY
+}
+
+func (a *Arithmetic[V]) Next() string {
+	token := a.Peek()
+	a.Position++
+	return token
+}
+
+// reports a token left over once the expression was read
+func (a *Arithmetic[V]) End() error {
+	if a.Position != len(a.Tokens) {
+		return errors.New("token " + a.Tokens[a.Position] + " inesperado em expressão")
+	}
+	return nil
+}
+
+func (a *Arithmetic[V]) Sum() (V, error) {
+	left, err := a.Product()
+	for err == nil && (a.Peek() == "+" || a.Peek() == "-") {
+		operator := a.Next()
+		var right V
+		right, err = a.Product()
+		if err != nil {
+			break
+		}
+		if operator == "+" {
+			left, err = a.Values.Add(left, right)
+		} else {
+			left, err = a.Values.Subtract(left, right)
+		}
+	}
+	return left, err
+}
+
+func (a *Arithmetic[V]) Product() (V, error) {
+	left, err := a.Factor()
+	for err == nil && (a.Peek() == "*" || a.Peek() == "/") {
+		operator := a.Next()
+		var right V
+		right, err = a.Factor()
+		if err != nil {
+			break
+		}
+		if operator == "*" {
+			left, err = a.Values.Multiply(left, right)
+		} else {
+			left, err = a.Values.Divide(left, right)
+		}
+	}
+	return left, err
+}
+
+func (a *Arithmetic[V]) Factor() (V, error) {
+	token := a.Next()
+	switch token {
+	case EMPTY:
+		var zero V
+		return zero, errors.New("expressão incompleta")
+
+	case "+":
+		return a.Factor()
+
+	case "-":
+		value, err := a.Factor()
+		if err != nil {
+			return value, err
+		}
+		return a.Values.Negate(value)
+
+	case "(":
+		value, err := a.Values.Group()
+		if err != nil {
+			return value, err
+		}
+		if a.Next() != ")" {
+			return value, errors.New("faltando ')' em expressão")
+		}
+		return value, nil
+	}
+
+	return a.Values.Operand(token)
+}
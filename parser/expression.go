@@ -0,0 +1,128 @@
+package parser
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const expressionOperators = "+-*/()"
+
+// splits an operand expression into symbols, literals and operators.
+// Literals keep their original spelling (10, H'1F', @5, @'A') so they can
+// be converted by the assembler.
+func ExpressionTokens(expression string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		start := i
+		switch {
+		case unicode.IsSpace(runes[i]):
+			i++
+			continue
+
+		case strings.ContainsRune(expressionOperators, runes[i]):
+			i++
+
+		case runes[i] == '@':
+			i++
+			if i < len(runes) && runes[i] == 'H' &&
+				i+1 < len(runes) && runes[i+1] == '\'' {
+				i++
+			}
+			if i < len(runes) && runes[i] == '\'' {
+				end, err := closingApostrophe(runes, i)
+				if err != nil {
+					return nil, err
+				}
+				i = end + 1
+			} else {
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+
+		case runes[i] == 'H' && i+1 < len(runes) && runes[i+1] == '\'':
+			end, err := closingApostrophe(runes, i+1)
+			if err != nil {
+				return nil, err
+			}
+			i = end + 1
+
+		case unicode.IsLetter(runes[i]):
+			for i < len(runes) &&
+				(unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+
+		case unicode.IsDigit(runes[i]):
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+
+		default:
+			return nil, errors.New(
+				"caractere inesperado '" + string(runes[i]) + "' em expressão")
+		}
+
+		tokens = append(tokens, string(runes[start:i]))
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("expressão vazia")
+	}
+	return tokens, nil
+}
+
+// open is the index of the opening apostrophe
+func closingApostrophe(runes []rune, open int) (int, error) {
+	for i := open + 1; i < len(runes); i++ {
+		if runes[i] == '\'' {
+			return i, nil
+		}
+	}
+	return 0, errors.New("faltando apóstrofo em expressão")
+}
+
+// the value of a literal: decimal (10), hexadecimal (H'1F') or marked with
+// @ (@5, @'5'). A character literal is the character minus '0', STRING gives
+// character codes. It must fit in bitSize bits.
+func LiteralValue(literal string, bitSize int) (int64, error) {
+	apostrophe := byte('\'')
+	isHexadecimal := strings.HasPrefix(literal, "H'") && len(literal) > 3
+	isLiteral := literal[0] == '@' && len(literal) > 1
+	switch {
+	case isHexadecimal:
+		if literal[len(literal)-1] != apostrophe {
+			return 0, errors.New("faltando apostrofos em número hexadecimal")
+		}
+		value, err := strconv.ParseInt(literal[2:len(literal)-1], 16, bitSize)
+		if err != nil {
+			return 0, errors.New("número hexadecimal inválido")
+		}
+		return value, nil
+
+	case isLiteral:
+		// if is char literal
+		if len(literal) > 3 && literal[1] == apostrophe && literal[3] == apostrophe {
+			value := int64(literal[2]) - '0'
+			if value < 0 {
+				return 0, errors.New("converção de literal inválida")
+			}
+			return value, nil
+		}
+		value, err := strconv.ParseInt(literal[1:], 10, bitSize)
+		if err != nil {
+			return 0, errors.New("literal decimal inválido")
+		}
+		return value, nil
+	}
+
+	value, err := strconv.ParseInt(literal, 10, bitSize)
+	if err != nil {
+		return 0, errors.New("número " + literal + " não reconhecido")
+	}
+	return value, nil
+}
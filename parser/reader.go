@@ -2,11 +2,14 @@ package parser
 
 import (
 	"bufio"
+	"strings"
 	"unicode"
 )
 
 const EMPTY = ""
 
+const maxLineLength = 80
+
 // TODO: Trocar para ler por linha
 /*
 func scanLines(assembler Assembler, path string, callback func(assembler Assembler, line string)) {
@@ -30,10 +33,23 @@ func scanLines(assembler Assembler, path string, callback func(assembler Assembl
 }
 */
 
+// operations whose operands may hold text between apostrophes
+var textOperations = map[string]bool{"STRING": true, "STRINGZ": true, "DATA": true}
+
 // starting at a non-space character, returns string up until a space
 func getWord(line string) string {
+	return getOperand(line, false)
+}
+
+// like getWord, but in the operands of text operations spaces between
+// apostrophes belong to the word, as in 'HELLO WORLD'
+func getOperand(line string, text bool) string {
+	quoted := false
 	for i, v := range line {
-		if unicode.IsSpace(v) {
+		if v == '\'' && text {
+			quoted = !quoted
+		}
+		if unicode.IsSpace(v) && !quoted {
 			return line[:i]
 		}
 	}
@@ -44,8 +60,12 @@ func getWord(line string) string {
 
 // returns empty string if no words left
 func skipUntilNextWord(line string) string {
+	return skipOperand(line, false)
+}
+
+func skipOperand(line string, text bool) string {
 	// skips current word
-	line = line[len(getWord(line)):]
+	line = line[len(getOperand(line, text)):]
 
 	for i, v := range line {
 		if !unicode.IsSpace(v) {
@@ -63,31 +83,46 @@ func beginsComment(line string) bool {
 	return line[0] == '*'
 }
 
-// assumes line is not a comment, if something optional is missing, returns EMPTY string instead
-func Line(line string) (label string, operation string, op1 string, op2 string) {
+// an error found at a column of a line, counting from 1
+type LineError struct {
+	Column  int
+	Message string
+}
+
+func (err *LineError) Error() string {
+	return err.Message
+}
+
+// assumes line is not a comment, if something optional is missing, returns EMPTY string instead.
+// A line with too many columns still returns its first four fields along with the error
+func Line(line string) (label string, operation string, op1 string, op2 string, err error) {
+	original := line
 	label = getWord(line)
 
 	line = skipUntilNextWord(line)
 	operation = getWord(line)
+	text := textOperations[operation]
 
 	line = skipUntilNextWord(line)
 	if beginsComment(line) {
-		return label, operation, EMPTY, EMPTY
+		return label, operation, EMPTY, EMPTY, nil
 	}
-	op1 = getWord(line)
+	op1 = getOperand(line, text)
 
-	line = skipUntilNextWord(line)
+	line = skipOperand(line, text)
 	if beginsComment(line) {
-		return label, operation, op1, EMPTY
+		return label, operation, op1, EMPTY, nil
 	}
-	op2 = getWord(line)
+	op2 = getOperand(line, text)
 
-	line = skipUntilNextWord(line)
+	line = skipOperand(line, text)
 	if len(line) != 0 && !beginsComment(line) {
-		panic("alguma linha tem colunas demais")
+		return label, operation, op1, op2, &LineError{
+			Column:  len(original) - len(line) + 1,
+			Message: "linha com colunas demais"}
 	}
 
-	return label, operation, op1, op2
+	return label, operation, op1, op2, nil
 }
 
 func MacroLine(line string) (label string, operation string, operands []string) {
@@ -95,6 +130,7 @@ func MacroLine(line string) (label string, operation string, operands []string)
 
 	line = skipUntilNextWord(line)
 	operation = getWord(line)
+	text := textOperations[operation]
 
 	line = skipUntilNextWord(line)
 	if len(line) == 0 || beginsComment(line) {
@@ -102,9 +138,9 @@ func MacroLine(line string) (label string, operation string, operands []string)
 	}
 
 	for {
-		op := getWord(line)
+		op := getOperand(line, text)
 		operands = append(operands, op)
-		line = skipUntilNextWord(line)
+		line = skipOperand(line, text)
 		if len(line) == 0 || beginsComment(line) {
 			break
 		}
@@ -113,16 +149,42 @@ func MacroLine(line string) (label string, operation string, operands []string)
 	return label, operation, operands
 }
 
-func ReadLine(scanner *bufio.Scanner) (line string, isComment bool) {
+// like MacroLine, for directives whose operands form one expression, such as
+// IF A GT 2 * B. A "*" there may be multiplication, so every word is kept and
+// the caller tells where a comment begins
+func ExpressionLine(line string) (label string, operation string, operands []string) {
+	label = getWord(line)
+
+	line = skipUntilNextWord(line)
+	operation = getWord(line)
+
+	line = skipUntilNextWord(line)
+	operands = []string{}
+	for len(line) != 0 {
+		operands = append(operands, getWord(line))
+		line = skipUntilNextWord(line)
+	}
+
+	return label, operation, operands
+}
+
+// blank lines count as comments. A line that is too long is still returned
+// along with the error, so the caller can report it and carry on
+func ReadLine(scanner *bufio.Scanner) (line string, isComment bool, err error) {
 	line = scanner.Text()
-	if len(line) > 80 {
-		panic("linha muito longa. Não deve haver mais de 80 caracteres numa linha.")
+	if strings.TrimSpace(line) == EMPTY {
+		return EMPTY, true, nil
+	}
+	if len(line) > maxLineLength {
+		err = &LineError{
+			Column:  maxLineLength + 1,
+			Message: "linha muito longa. Não deve haver mais de 80 caracteres numa linha."}
 	}
 
 	// whole line is a comment
 	if line[0] == '*' {
-		return EMPTY, true
+		return EMPTY, true, err
 	}
 
-	return line, false
+	return line, false, err
 }
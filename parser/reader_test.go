@@ -2,8 +2,10 @@ package parser
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -18,7 +20,10 @@ func TestParseLine(t *testing.T) {
 	i := 1
 	for scanner.Scan() {
 		line := scanner.Text()
-		label, operation, op1, op2 := Line(line)
+		label, operation, op1, op2, err := Line(line)
+		if err != nil {
+			t.Fatalf("linha %v gerou erro: %v", i, err)
+		}
 		fmt.Println("line", i, ":")
 		if label == "" {
 			label = "empty"
@@ -37,3 +42,62 @@ func TestParseLine(t *testing.T) {
 	}
 
 }
+
+func TestExpressionTokens(t *testing.T) {
+	tokens, err := ExpressionTokens("(TABLE+H'1F')*@'A'-@3/2")
+	if err != nil {
+		t.Fatalf("expressão válida gerou erro: %v", err)
+	}
+	goal := []string{"(", "TABLE", "+", "H'1F'", ")", "*", "@'A'", "-", "@3", "/", "2"}
+	if len(tokens) != len(goal) {
+		t.Fatalf("esperava-se %v, obteve-se %v", goal, tokens)
+	}
+	for i := range goal {
+		if tokens[i] != goal[i] {
+			t.Fatalf("esperava-se %v, obteve-se %v", goal, tokens)
+		}
+	}
+
+	if _, err := ExpressionTokens("A+H'1F"); err == nil {
+		t.Fatalf("hexadecimal sem apóstrofo final não gerou erro")
+	}
+	if _, err := ExpressionTokens("A%2"); err == nil {
+		t.Fatalf("caractere inválido não gerou erro")
+	}
+}
+
+func TestQuotedOperand(t *testing.T) {
+	label, operation, op1, op2, _ := Line("MSG   STRING 'HELLO WORLD' *comment")
+	if label != "MSG" || operation != "STRING" || op1 != "'HELLO WORLD'" || op2 != EMPTY {
+		t.Fatalf("linha com texto lida como %q %q %q %q", label, operation, op1, op2)
+	}
+
+	// apostrophes only group words in the operands of STRING, STRINGZ and DATA
+	label, operation, op1, op2, _ = Line("      LOAD   X'  Y'")
+	if label != EMPTY || operation != "LOAD" || op1 != "X'" || op2 != "Y'" {
+		t.Fatalf("linha sem texto lida como %q %q %q %q", label, operation, op1, op2)
+	}
+}
+
+func TestLineErrors(t *testing.T) {
+	_, _, _, _, err := Line("LABEL ADD A B C")
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) || lineErr.Column != 15 {
+		t.Fatalf("coluna extra deveria gerar erro na coluna 15, gerou %v", err)
+	}
+
+	text := "LONG ADD " + strings.Repeat("A", 80) + "\n\n   \n"
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	scanner.Scan()
+	line, isComment, err := ReadLine(scanner)
+	if !errors.As(err, &lineErr) || lineErr.Column != 81 || isComment || line == EMPTY {
+		t.Fatalf("linha longa deveria gerar erro na coluna 81 e ser lida, gerou %v", err)
+	}
+
+	for scanner.Scan() {
+		if _, isComment, err := ReadLine(scanner); !isComment || err != nil {
+			t.Fatalf("linha em branco deveria ser ignorada")
+		}
+	}
+}
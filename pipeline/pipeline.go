@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"saturn/assembler"
+	"saturn/linker"
+	"saturn/mp"
+	"saturn/shared"
+)
+
+// everything a build produces, in memory
+type Result struct {
+	Modules []assembler.Module // one per source that could be read
+	Image   *linker.Image      // nil if the build has errors
+}
+
+// Build runs the macro processor, the assembler and the linker over sources
+// without touching the build directory, INCLUDE and MACLIB files aside.
+// Sources are linked in the given order.
+func Build(options mp.Options, sources ...assembler.Source) (Result, []shared.Diagnostic) {
+	modules, diagnostics := assembler.Assemble(options, sources...)
+	result := Result{Modules: modules}
+
+	// the modules of a program with errors are not worth linking
+	if len(modules) == 0 || shared.HasErrors(diagnostics) {
+		return result, diagnostics
+	}
+
+	image, linkDiagnostics := linker.Link(modules)
+	diagnostics = append(diagnostics, linkDiagnostics...)
+	if !shared.HasErrors(linkDiagnostics) {
+		result.Image = &image
+	}
+	return result, diagnostics
+}
+
+// Build with the sources read from the files in paths
+func BuildFiles(options mp.Options, paths ...string) (Result, []shared.Diagnostic) {
+	sources, diagnostics := assembler.ReadSources(paths...)
+	result, buildDiagnostics := Build(options, sources...)
+	return result, append(diagnostics, buildDiagnostics...)
+}
+
+// writes the files of every module, and of the image if there is one, to
+// directory. Builds running at the same time should use different
+// directories.
+func (result Result) WriteFiles(directory string) error {
+	for _, module := range result.Modules {
+		if err := module.WriteFiles(directory); err != nil {
+			return err
+		}
+	}
+	if result.Image == nil {
+		return nil
+	}
+	return result.Image.WriteFiles(directory)
+}
@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"saturn/assembler"
+	"saturn/mp"
+	"saturn/shared"
+	"saturn/vm"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const program = `      START  MEM
+      MACRO
+      SOMA   &A &B
+      LOAD   &A
+      ADD    &B
+      MEND
+*
+MEM   LOAD   X
+      SOMA   X Y
+      STOP
+X     CONST  1
+Y     CONST  2
+      END
+`
+
+func TestBuildInMemory(t *testing.T) {
+	result, diagnostics := Build(mp.Options{},
+		assembler.Source{Name: "mem.asm", Reader: strings.NewReader(program)})
+	if shared.HasErrors(diagnostics) || result.Image == nil {
+		t.Fatalf("erros inesperados: %v", diagnostics)
+	}
+
+	module := result.Modules[0]
+	if module.Name != "MEM" || strings.Count(module.Expanded, "LOAD X") != 2 {
+		t.Fatalf("fonte expandido inesperado em %s:\n%s", module.Name, module.Expanded)
+	}
+	if !strings.Contains(module.Listing, "04   130 08 R             9+  ADD Y") {
+		t.Fatalf("faltando a expansão na listagem:\n%s", module.Listing)
+	}
+
+	want := []shared.Word{131, 7, 131, 7, 130, 8, 11, 1, 2}
+	if !slices.Equal(result.Image.Program, want) {
+		t.Fatalf("esperava-se %v, obteve-se %v", want, result.Image.Program)
+	}
+	if location, ok := shared.Locate(result.Image.SourceMap, 4); !ok ||
+		location.File != "mem.asm" || location.Line != 9 {
+		t.Fatalf("endereço 4: esperava-se mem.asm:9, obteve-se %+v", location)
+	}
+
+	// files are only written by WriteFiles
+	if _, err := os.Stat(shared.BuildDirectory); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("%s não deveria existir: %v", shared.BuildDirectory, err)
+	}
+}
+
+func TestBuildWithErrors(t *testing.T) {
+	source := strings.Replace(program, "STOP", "STOPP", 1)
+	result, diagnostics := Build(mp.Options{},
+		assembler.Source{Name: "mem.asm", Reader: strings.NewReader(source)})
+	if !shared.HasErrors(diagnostics) || result.Image != nil || len(result.Modules) != 1 {
+		t.Fatalf("esperava-se um módulo com erros e nenhuma imagem, obteve-se %v", diagnostics)
+	}
+	if !strings.Contains(result.Modules[0].Listing, "operação STOPP é inválida") {
+		t.Fatalf("o erro deveria estar na listagem:\n%s", result.Modules[0].Listing)
+	}
+}
+
+func TestConcurrentBuilds(t *testing.T) {
+	// each program skips i STOPs to start at its label and leaves 2*i in
+	// the accumulator, so builds and machines must not share their entry
+	const programs = 8
+	var wait sync.WaitGroup
+	errs := make([]error, programs)
+	for i := 0; i < programs; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			source := "      START  P\n" + strings.Repeat("      STOP\n", i) +
+				fmt.Sprintf("P     LOAD   #%d\n      ADD    #%d\n      STOP\n      END\n", i, i)
+			result, diagnostics := Build(mp.Options{}, assembler.Source{
+				Name: fmt.Sprintf("p%d.asm", i), Reader: strings.NewReader(source)})
+			if result.Image == nil {
+				errs[i] = fmt.Errorf("programa %d: %v", i, diagnostics)
+				return
+			}
+
+			machine := vm.New(result.Image.StackSize, result.Image.Start)
+			err := machine.LoadProgram(result.Image.Program)
+			if err == nil {
+				err = machine.ExecuteAll()
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("programa %d: %v", i, err)
+				return
+			}
+			if result.Image.Start != uint16(i) || machine.Accumulator() != shared.Word(2*i) {
+				errs[i] = fmt.Errorf("programa %d: início %d e acumulador %d", i,
+					result.Image.Start, machine.Accumulator())
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMachineFault(t *testing.T) {
+	// the machine stops at the division instead of panicking
+	source := "      START  P\nP     LOAD   #1\n      DIVIDE #0\n      STOP\n      END\n"
+	result, diagnostics := Build(mp.Options{},
+		assembler.Source{Name: "fault.asm", Reader: strings.NewReader(source)})
+	if result.Image == nil {
+		t.Fatalf("erros inesperados: %v", diagnostics)
+	}
+
+	machine := vm.New(result.Image.StackSize, result.Image.Start)
+	if err := machine.LoadProgram(result.Image.Program); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.ExecuteAll(); err == nil || machine.IsRunning() || machine.PC() != 4 {
+		t.Fatalf("esperava-se uma falha parando a máquina depois do DIVIDE, obteve-se %v em %d",
+			err, machine.PC())
+	}
+	location, ok := shared.Locate(result.Image.SourceMap, 2)
+	if !ok || location.Line != 3 {
+		t.Fatalf("esperava-se o DIVIDE na linha 3, obteve-se %+v", location)
+	}
+}
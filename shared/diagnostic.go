@@ -0,0 +1,125 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (severity Severity) String() string {
+	if severity == Warning {
+		return "aviso"
+	}
+	return "erro"
+}
+
+// severities are written in english in JSON, like the codes
+func (severity Severity) MarshalText() ([]byte, error) {
+	if severity == Warning {
+		return []byte("warning"), nil
+	}
+	return []byte("error"), nil
+}
+
+// codes tell tools what kind of problem a diagnostic is about, the message
+// is meant for people and may change
+const (
+	CodeIO              = "io"
+	CodeLineFormat      = "line-format"   // line too long or with too many columns
+	CodeMacro           = "macro"         // macro definition or expansion
+	CodeInclude         = "include"       // file not found, circular inclusion
+	CodeConditional     = "conditional"   // IF, ELSE and ENDIF
+	CodeMacroLibrary    = "macro-library" // MACLIB or -maclib
+	CodeMacroRedefined  = "macro-redefined"
+	CodeSyntax          = "syntax"            // wrong operands for an operation
+	CodeUnknownOp       = "unknown-operation" // not an instruction, pseudo-instruction or macro
+	CodeOperand         = "operand"           // invalid number, expression or address mode
+	CodeSymbol          = "symbol"            // invalid or duplicated symbol
+	CodeUndefinedSymbol = "undefined-symbol"
+	CodeUnusedSymbol    = "unused-symbol"
+	CodeProgram         = "program" // missing name, END or entry point
+	CodeDuplicateGlobal = "duplicate-global"
+	CodeObject          = "object"  // object the linker cannot read
+	CodeRuntime         = "runtime" // fault of the machine running the program
+	CodeInternal        = "internal"
+)
+
+// a problem found while building a program. Line and Column start at 1,
+// 0 means the problem is not tied to a line or column. Problems found while
+// expanding macros are at the line that called the outermost macro.
+type Diagnostic struct {
+	File       string      `json:"file"`
+	Line       int         `json:"line"`
+	Column     int         `json:"column"`
+	Severity   Severity    `json:"severity"`
+	Code       string      `json:"code"`
+	Message    string      `json:"message"`
+	Expansions []Expansion `json:"expansions,omitempty"` // outermost first
+}
+
+// a macro being expanded and the statement of its body that was being
+// expanded, which may be a call to the next macro
+type Expansion struct {
+	Macro string `json:"macro"`
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+}
+
+func (expansion Expansion) String() string {
+	return fmt.Sprintf("%s (%s:%d)", expansion.Macro, filepath.Base(expansion.File), expansion.Line)
+}
+
+func (diagnostic Diagnostic) String() string {
+	position := filepath.Base(diagnostic.File)
+	if diagnostic.Line != 0 {
+		position += fmt.Sprintf(":%d", diagnostic.Line)
+		if diagnostic.Column != 0 {
+			position += fmt.Sprintf(":%d", diagnostic.Column)
+		}
+	}
+	return fmt.Sprintf("%s: %v: %s%s", position, diagnostic.Severity, diagnostic.Message,
+		diagnostic.Backtrace())
+}
+
+// the macros being expanded, as " em A (a.asm:3) > B (lib.mac:7)", empty
+// outside expansions
+func (diagnostic Diagnostic) Backtrace() string {
+	if len(diagnostic.Expansions) == 0 {
+		return ""
+	}
+	var expansions []string
+	for _, expansion := range diagnostic.Expansions {
+		expansions = append(expansions, expansion.String())
+	}
+	return " em " + strings.Join(expansions, " > ")
+}
+
+// reports whether any of diagnostics is an error, warnings don't stop a build
+func HasErrors(diagnostics []Diagnostic) bool {
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// writes diagnostics as a JSON array, empty rather than null when there are none
+func WriteDiagnosticsJSON(writer io.Writer, diagnostics []Diagnostic) error {
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false) // messages may hold cycles like A > B > A
+	return encoder.Encode(diagnostics)
+}
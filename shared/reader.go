@@ -0,0 +1,31 @@
+package shared
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// the words of a .hpx file, SPACE words ("XX") are 0
+func ParseProgram(reader io.Reader) ([]Word, error) {
+	scanner := bufio.NewScanner(reader)
+	var program []Word
+
+	for scanner.Scan() {
+		for i, field := range strings.Fields(scanner.Text()) {
+			if i == 0 && field == "XX" { // if SPACE
+				program = append(program, Word(0))
+				break
+			}
+			word, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, errors.New("palavra " + field + " inválida no executável")
+			}
+			program = append(program, Word(word))
+		}
+	}
+
+	return program, scanner.Err()
+}
@@ -1,10 +1,11 @@
 package shared
 
 import (
-	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -23,6 +24,47 @@ type SymbolInfo struct {
 	Mode    byte
 }
 
+// a symbol of a linked program, as written to the .sym file
+type Symbol struct {
+	Name    string
+	Address uint16
+	Module  string
+	Global  bool // defined with INTDEF
+}
+
+// where the word at an image address came from, as written to the .map file
+type SourceLocation struct {
+	Address uint16
+	Module  string
+	File    string
+	Line    int
+	Macros  []string // macros being expanded, outermost first
+	Symbol  string   // closest label at or before the address, as LABEL+offset
+}
+
+func (location SourceLocation) String() string {
+	description := fmt.Sprintf("%s:%d", filepath.Base(location.File), location.Line)
+	if len(location.Macros) != 0 {
+		description += " [" + strings.Join(location.Macros, " > ") + "]"
+	}
+	if location.Symbol != "" {
+		description += " (" + location.Symbol + ")"
+	}
+	return description
+}
+
+// the location of the line that generated address, which may be in the
+// middle of an instruction. locations must be sorted by address.
+func Locate(locations []SourceLocation, address uint16) (SourceLocation, bool) {
+	i := sort.Search(len(locations), func(i int) bool {
+		return locations[i].Address > address
+	})
+	if i == 0 {
+		return SourceLocation{}, false
+	}
+	return locations[i-1], true
+}
+
 const (
 	DIRECT AddressMode = iota
 	INDIRECT
@@ -72,8 +114,6 @@ const (
 	INJ    Operation = 9
 )
 
-var ProgramStart int = -1
-var ProgramIndexOfStart int
 var OpSizes map[Operation]uint16 = map[Operation]uint16{
 	ADD:    2,
 	BR:     2,
@@ -117,21 +157,19 @@ func Btop(bp BinProgram) Program {
 	return p
 }
 
-func ExtractAddressMode(operation Word) AddressMode {
-	addressModeBits := int(operation) >> 5
-
-	addressModes := map[uint16]AddressMode{
-		0b01_00: DIRECT,
-		0b10_00: INDIRECT,
-		0b11_00: IMMEDIATE,
-		0b01_10: DIRECT_INDIRECT,
-		0b10_01: INDIRECT_DIRECT,
-		0b01_11: DIRECT_IMMEDIATE,
-		0b10_11: INDIRECT_IMMEDIATE,
-		0b00_00: UNUSED,
-	}
+var addressModes = map[uint16]AddressMode{
+	0b01_00: DIRECT,
+	0b10_00: INDIRECT,
+	0b11_00: IMMEDIATE,
+	0b01_10: DIRECT_INDIRECT,
+	0b10_01: INDIRECT_DIRECT,
+	0b01_11: DIRECT_IMMEDIATE,
+	0b10_11: INDIRECT_IMMEDIATE,
+	0b00_00: UNUSED,
+}
 
-	mode, ok := addressModes[uint16(addressModeBits)]
+func ExtractAddressMode(operation Word) AddressMode {
+	mode, ok := AddressModeOf(operation)
 	if !ok {
 		panic("invalid address mode in instruction")
 	}
@@ -139,6 +177,13 @@ func ExtractAddressMode(operation Word) AddressMode {
 	return mode
 }
 
+// the address mode of operation, false if its bits mean none
+func AddressModeOf(operation Word) (AddressMode, bool) {
+	addressModeBits := int(operation) >> 5
+	mode, ok := addressModes[uint16(addressModeBits)]
+	return mode, ok
+}
+
 func ExtractOpCode(operation Word) Operation {
 	return Operation(operation & 0b0000000_00_00_11111)
 }
@@ -147,51 +192,21 @@ func (i Instruction) String() string {
 	return fmt.Sprintf("%d<(%d) [%d, %d]>", i.AddressMode, i.Operation, i.Operands.First, i.Operands.Second)
 }
 
-func CreateBuildFile(fileName string) (*os.File, error) {
-	// if is test (debugging behaves differently)
-	if strings.HasSuffix(os.Args[0], ".test") {
-		buildPath := filepath.Join("..", "build")
-		exists := directoryExists(buildPath)
-		if !exists {
-			os.MkdirAll(buildPath, 0777)
-		}
-		path := filepath.Join(buildPath, fileName)
-		file, err := os.Create(path)
-		return file, err
-	} else {
-		exists := directoryExists("build")
-		if !exists {
-			os.MkdirAll("build", 0777)
-		}
-		file, err := os.Create(filepath.Join("build", fileName))
-		return file, err
-	}
-}
+// where build files go by default, under the working directory
+const BuildDirectory = "build"
 
-func OpenBuildFile(fileName string) (*os.File, error) {
-	// if is test (debugging behaves differently)
-	if strings.HasSuffix(os.Args[0], ".test") {
-		buildPath := filepath.Join("..", "build")
-		path := filepath.Join(buildPath, fileName)
-		file, err := os.Open(path)
-		return file, err
-
-	} else {
-		file, err := os.Open(filepath.Join("build", fileName))
-		return file, err
+// creates fileName in directory and lets write fill it
+func WriteBuildFile(directory, fileName string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(directory, 0777); err != nil {
+		return err
 	}
-}
-
-// exists returns whether the given directory exists
-// panics on wrong kind of error
-func directoryExists(path string) bool {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true
+	file, err := os.Create(filepath.Join(directory, fileName))
+	if err != nil {
+		return err
 	}
-	if errors.Is(err, os.ErrNotExist) {
-		return false
-	} else {
-		panic(err)
+	if err := write(file); err != nil {
+		file.Close()
+		return err
 	}
+	return file.Close()
 }
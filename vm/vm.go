@@ -2,6 +2,7 @@ package vm
 
 import (
 	"errors"
+	"fmt"
 	"saturn/shared"
 )
 
@@ -14,25 +15,28 @@ type VirtualMachine struct {
 	accumulator    shared.Word
 	operation      shared.Operation
 	memoryAddress  uint16
-	opImpls        map[shared.Operation]func(shared.Operands, shared.AddressMode)
+	opImpls        map[shared.Operation]func(shared.Operands, shared.AddressMode) error
 	isRunning      bool
 	stackLimit     uint16
 	programBase    uint16
 	programEnd     uint16
+	programStart   uint16 // where Reset puts the program counter
 	io             struct {
 		input  shared.Word
 		output shared.Word
 	}
 }
 
-func New(stackLimitArg uint16) *VirtualMachine {
+// a machine for a program that starts at start, an address of its image
+func New(stackLimitArg, start uint16) *VirtualMachine {
 	vm := new(VirtualMachine)
 	vm.setupOperations()
-	vm.stackInit()
 	vm.isRunning = true
 	vm.stackLimit = stackLimitArg
+	vm.stackInit()
 	vm.programBase = stackBase + vm.stackLimit + 1
-	vm.programCounter = uint16(shared.ProgramStart)
+	vm.programStart = start
+	vm.programCounter = start
 	return vm
 }
 
@@ -48,6 +52,20 @@ func (vm *VirtualMachine) SP() uint16 {
 	return vm.stackPointer
 }
 
+// address of the cell holding the stack limit, frames follow it
+func (vm *VirtualMachine) StackBase() uint16 {
+	return stackBase
+}
+
+func (vm *VirtualMachine) StackLimit() uint16 {
+	return vm.stackLimit
+}
+
+// address where the program image is loaded, right after the stack
+func (vm *VirtualMachine) ProgramBase() uint16 {
+	return vm.programBase
+}
+
 func (vm *VirtualMachine) Accumulator() shared.Word {
 	return vm.accumulator
 }
@@ -72,24 +90,23 @@ func (vm *VirtualMachine) SetInput(data uint16) {
 	vm.io.input = shared.Word(data)
 }
 
-func (vm *VirtualMachine) LoadProgram(program []shared.Word) {
-	var i uint16
+// the machine is left as it was if the program doesn't fit after the stack
+func (vm *VirtualMachine) LoadProgram(program []shared.Word) error {
+	if int(vm.programBase)+len(program) > len(vm.memory) {
+		return errors.New("the program exceeds the memory space")
+	}
 
+	var i uint16
 	for i = 0; i < uint16(len(program)); i++ {
-		putAddress := vm.programBase + i
-
-		if putAddress >= uint16(len(vm.memory)) {
-			panic("the program exceeds the memory space")
-		}
-
-		vm.memory[putAddress] = program[i]
+		vm.memory[vm.programBase+i] = program[i]
 	}
 
 	vm.programEnd = i + vm.programBase
+	return nil
 }
 
 func (vm *VirtualMachine) setupOperations() {
-	vm.opImpls = map[shared.Operation]func(shared.Operands, shared.AddressMode){
+	vm.opImpls = map[shared.Operation]func(shared.Operands, shared.AddressMode) error{
 		shared.ADD:    vm.add,
 		shared.BR:     vm.br,
 		shared.BRNEG:  vm.brneg,
@@ -122,8 +139,12 @@ func (vm *VirtualMachine) stackPush(value shared.Word) error {
 		return errors.New("stack overflow")
 	}
 
-	address := vm.stackPointer + stackBase
-	vm.memory[address] = value
+	cell, err := vm.cell(int(vm.stackPointer + stackBase))
+	if err != nil {
+		vm.stackPointer--
+		return err
+	}
+	*cell = value
 
 	return nil
 }
@@ -133,20 +154,23 @@ func (vm *VirtualMachine) stackPop() (uint16, error) {
 		return 0, errors.New("empty stack")
 	}
 
-	address := vm.stackPointer + stackBase
+	cell, err := vm.cell(int(vm.stackPointer + stackBase))
+	if err != nil {
+		return 0, err
+	}
 	vm.stackPointer--
 
-	return uint16(vm.memory[address]), nil
+	return uint16(*cell), nil
 }
 
 func (vm *VirtualMachine) Reset() {
-	vm.programCounter = uint16(shared.ProgramStart)
+	vm.programCounter = vm.programStart
 	vm.accumulator = 0
 	vm.operation = 0
 	vm.memoryAddress = 0
 	vm.stackPointer = 0
 
-	for i := 0; i < int(vm.programBase); i++ {
+	for i := 0; i < int(vm.programBase) && i < len(vm.memory); i++ {
 		vm.memory[i] = 0
 	}
 
@@ -158,262 +182,329 @@ func (vm *VirtualMachine) Reset() {
 	vm.isRunning = true
 }
 
-func (vm *VirtualMachine) decodeInst() shared.Instruction {
-	address := vm.programBase + vm.programCounter
-	operationInfo := vm.memory[address]
+// the memory cell at address, an error if there is no such cell
+func (vm *VirtualMachine) cell(address int) (*shared.Word, error) {
+	if address < 0 || address >= len(vm.memory) {
+		return nil, fmt.Errorf("address %d outside the memory", address)
+	}
+	return &vm.memory[address], nil
+}
 
-	var operands shared.Operands
+func (vm *VirtualMachine) decodeInst() (shared.Instruction, error) {
+	address := int(vm.programBase + vm.programCounter)
+	operationInfo, err := vm.cell(address)
+	if err != nil {
+		return shared.Instruction{}, fmt.Errorf("program counter %d: %w", vm.programCounter, err)
+	}
+	addressMode, ok := shared.AddressModeOf(*operationInfo)
+	if !ok {
+		return shared.Instruction{}, errors.New("invalid address mode in instruction")
+	}
 
-	operands.First = vm.memory[address+1]
-	operands.Second = vm.memory[address+2] // might be trash, but when it is, it won`t be used by the instruction
+	// might be trash, but when it is, it won`t be used by the instruction
+	var operands shared.Operands
+	if first, err := vm.cell(address + 1); err == nil {
+		operands.First = *first
+	}
+	if second, err := vm.cell(address + 2); err == nil {
+		operands.Second = *second
+	}
 
 	return shared.Instruction{
-		AddressMode: shared.ExtractAddressMode(operationInfo),
-		Operation:   shared.ExtractOpCode(operationInfo),
+		AddressMode: addressMode,
+		Operation:   shared.ExtractOpCode(*operationInfo),
 		Operands:    operands,
+	}, nil
+}
+
+// runs the instruction at the program counter, a fault stops the machine
+func (vm *VirtualMachine) Execute() error {
+	err := vm.execute()
+	if err != nil {
+		vm.isRunning = false
 	}
+	return err
 }
 
-func (vm *VirtualMachine) Execute() {
-	instr := vm.decodeInst()
+func (vm *VirtualMachine) execute() error {
+	instr, err := vm.decodeInst()
+	if err != nil {
+		return err
+	}
+	opImpl, ok := vm.opImpls[instr.Operation]
+	if !ok {
+		return fmt.Errorf("unknown operation %d", instr.Operation)
+	}
 
 	vm.operation = instr.Operation
 	vm.programCounter += shared.OpSizes[instr.Operation]
 
-	vm.opImpls[instr.Operation](instr.Operands, instr.AddressMode)
+	return opImpl(instr.Operands, instr.AddressMode)
 }
 
-func (vm *VirtualMachine) ExecuteAll() {
+// runs the program from the start until it stops or faults
+func (vm *VirtualMachine) ExecuteAll() error {
 	vm.Reset()
 
 	for vm.isRunning {
-		vm.Execute()
+		if err := vm.Execute(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // -- Operations
 
-func (vm *VirtualMachine) add(operands shared.Operands, mode shared.AddressMode) {
+// the value of an operand in the modes most operations take
+func (vm *VirtualMachine) value(operand shared.Word, mode shared.AddressMode) (shared.Word, error) {
 	switch mode {
 	case shared.IMMEDIATE:
-		vm.accumulator += operands.First
-
+		return operand, nil
 	case shared.DIRECT:
-		vm.accumulator += vm.memory[operands.First]
-
-	case shared.INDIRECT:
-		vm.accumulator += vm.memory[vm.memoryAddress]
-
+		cell, err := vm.cell(int(operand))
+		if err != nil {
+			return 0, err
+		}
+		return *cell, nil
 	default:
-		panic("incorrect address mode on ADD operation")
+		cell, err := vm.cell(int(vm.memoryAddress))
+		if err != nil {
+			return 0, err
+		}
+		return *cell, nil
 	}
 }
 
-func (vm *VirtualMachine) br(operands shared.Operands, mode shared.AddressMode) {
-	var targetAddress uint16
-
-	switch mode {
-	case shared.DIRECT:
-		targetAddress = uint16(vm.memory[operands.First])
-
-	case shared.INDIRECT:
-		targetAddress = uint16(vm.memory[vm.memoryAddress])
+func (vm *VirtualMachine) add(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.IMMEDIATE && mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on ADD operation")
+	}
+	value, err := vm.value(operands.First, mode)
+	if err != nil {
+		return err
+	}
+	vm.accumulator += value
+	return nil
+}
 
-	default:
-		panic("incorrect address mode on BR operation")
+func (vm *VirtualMachine) br(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on BR operation")
+	}
+	targetAddress, err := vm.value(operands.First, mode)
+	if err != nil {
+		return err
 	}
 
-	vm.programCounter = targetAddress
+	vm.programCounter = uint16(targetAddress)
+	return nil
 }
 
-func (vm *VirtualMachine) brneg(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) brneg(operands shared.Operands, mode shared.AddressMode) error {
 	if mode != shared.DIRECT && mode != shared.INDIRECT {
-		panic("incorrect address mode on BRNEG operation")
+		return errors.New("incorrect address mode on BRNEG operation")
 	}
 
 	if vm.accumulator < 0 {
-		vm.br(operands, mode)
+		return vm.br(operands, mode)
 	}
+	return nil
 }
 
-func (vm *VirtualMachine) brpos(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) brpos(operands shared.Operands, mode shared.AddressMode) error {
 	if mode != shared.DIRECT && mode != shared.INDIRECT {
-		panic("incorrect address mode on BRPOS operation")
+		return errors.New("incorrect address mode on BRPOS operation")
 	}
 
 	if vm.accumulator > 0 {
-		vm.br(operands, mode)
+		return vm.br(operands, mode)
 	}
+	return nil
 }
 
-func (vm *VirtualMachine) brzero(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) brzero(operands shared.Operands, mode shared.AddressMode) error {
 	if vm.accumulator == 0 {
-		vm.br(operands, mode)
+		return vm.br(operands, mode)
 	}
+	return nil
 }
 
-func (vm *VirtualMachine) call(operands shared.Operands, mode shared.AddressMode) {
-
-	err := vm.stackPush(shared.Word(vm.programCounter))
+func (vm *VirtualMachine) call(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on CALL operation")
+	}
+	targetAddress, err := vm.value(operands.First, mode)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	switch mode {
-	case shared.DIRECT:
-		vm.programCounter = uint16(vm.memory[operands.First])
-
-	case shared.INDIRECT:
-		vm.programCounter = uint16(vm.memory[vm.memoryAddress])
-
-	default:
-		panic("incorrect address mode on CALL operation")
+	if err := vm.stackPush(shared.Word(vm.programCounter)); err != nil {
+		return err
 	}
+	vm.programCounter = uint16(targetAddress)
+	return nil
 }
 
-func (vm *VirtualMachine) copy(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) copy(operands shared.Operands, mode shared.AddressMode) error {
+	var target int
+	var value shared.Word
+	var err error
 	switch mode {
 	case shared.DIRECT:
-		vm.memory[operands.First] = vm.memory[operands.Second]
+		target = int(operands.First)
+		value, err = vm.value(operands.Second, shared.DIRECT)
 
 	case shared.DIRECT_IMMEDIATE:
-		vm.memory[operands.First] = operands.Second
+		target, value = int(operands.First), operands.Second
 
 	case shared.DIRECT_INDIRECT:
-		vm.memory[operands.First] = vm.memory[vm.memoryAddress]
+		target = int(operands.First)
+		value, err = vm.value(operands.Second, shared.INDIRECT)
 
 	case shared.INDIRECT:
-		break
+		return nil
 
 	case shared.INDIRECT_IMMEDIATE:
-		vm.memory[vm.memoryAddress] = operands.Second
+		target, value = int(vm.memoryAddress), operands.Second
 
 	case shared.INDIRECT_DIRECT:
-		vm.memory[vm.memoryAddress] = vm.memory[operands.Second]
+		target = int(vm.memoryAddress)
+		value, err = vm.value(operands.Second, shared.DIRECT)
 
 	default:
-		panic("incorrect address mode on COPY operation")
+		return errors.New("incorrect address mode on COPY operation")
+	}
+	if err != nil {
+		return err
 	}
-}
-
-func (vm *VirtualMachine) divide(operands shared.Operands, mode shared.AddressMode) {
-	switch mode {
-	case shared.IMMEDIATE:
-		vm.accumulator = vm.accumulator / operands.First
-
-	case shared.DIRECT:
-		vm.accumulator = vm.accumulator / vm.memory[operands.First]
-
-	case shared.INDIRECT:
-		vm.accumulator = vm.accumulator / vm.memory[vm.memoryAddress]
 
-	default:
-		panic("incorrect address mode on DIVIDE operation")
+	cell, err := vm.cell(target)
+	if err != nil {
+		return err
 	}
+	*cell = value
+	return nil
 }
 
-func (vm *VirtualMachine) load(operands shared.Operands, mode shared.AddressMode) {
-	switch mode {
-	case shared.IMMEDIATE:
-		vm.accumulator = operands.First
-
-	case shared.DIRECT:
-		vm.accumulator = vm.memory[operands.First]
-
-	case shared.INDIRECT:
-		vm.accumulator = vm.memory[vm.memoryAddress]
-
-	default:
-		panic("incorrect address mode on LOAD operation")
+func (vm *VirtualMachine) divide(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.IMMEDIATE && mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on DIVIDE operation")
+	}
+	value, err := vm.value(operands.First, mode)
+	if err != nil {
+		return err
+	}
+	if value == 0 {
+		return errors.New("division by zero")
 	}
+	vm.accumulator = vm.accumulator / value
+	return nil
 }
 
-func (vm *VirtualMachine) mult(operands shared.Operands, mode shared.AddressMode) {
-	switch mode {
-	case shared.IMMEDIATE:
-		vm.accumulator = vm.accumulator * operands.First
-
-	case shared.DIRECT:
-		vm.accumulator = vm.accumulator * vm.memory[operands.First]
-
-	case shared.INDIRECT:
-		vm.accumulator = vm.accumulator * vm.memory[vm.memoryAddress]
+func (vm *VirtualMachine) load(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.IMMEDIATE && mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on LOAD operation")
+	}
+	value, err := vm.value(operands.First, mode)
+	if err != nil {
+		return err
+	}
+	vm.accumulator = value
+	return nil
+}
 
-	default:
-		panic("incorrect address mode on MULT operation")
+func (vm *VirtualMachine) mult(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.IMMEDIATE && mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on MULT operation")
 	}
+	value, err := vm.value(operands.First, mode)
+	if err != nil {
+		return err
+	}
+	vm.accumulator = vm.accumulator * value
+	return nil
 }
 
-func (vm *VirtualMachine) read(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) read(operands shared.Operands, mode shared.AddressMode) error {
+	var target int
 	switch mode {
 	case shared.DIRECT:
-		vm.memory[operands.First] = vm.io.input
+		target = int(operands.First)
 	case shared.DIRECT_INDIRECT:
-		vm.memory[vm.memoryAddress] = vm.io.input
+		target = int(vm.memoryAddress)
 	default:
-		panic("incorrect address mode on READ operation")
+		return errors.New("incorrect address mode on READ operation")
 	}
+
+	cell, err := vm.cell(target)
+	if err != nil {
+		return err
+	}
+	*cell = vm.io.input
+	return nil
 }
 
-func (vm *VirtualMachine) ret(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) ret(operands shared.Operands, mode shared.AddressMode) error {
 	var err error
 	vm.programCounter, err = vm.stackPop()
-
-	if err != nil {
-		panic(err)
-	}
+	return err
 }
 
-func (vm *VirtualMachine) stop(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) stop(operands shared.Operands, mode shared.AddressMode) error {
 	vm.isRunning = false
+	return nil
 }
 
-func (vm *VirtualMachine) store(operands shared.Operands, mode shared.AddressMode) {
+func (vm *VirtualMachine) store(operands shared.Operands, mode shared.AddressMode) error {
+	var target int
 	switch mode {
 	case shared.DIRECT:
-		vm.memory[operands.First] = vm.accumulator
+		target = int(operands.First)
 
 	case shared.INDIRECT:
-		vm.memory[vm.memoryAddress] = vm.accumulator
+		target = int(vm.memoryAddress)
 
 	default:
-		panic("incorrect address mode on STORE operation")
+		return errors.New("incorrect address mode on STORE operation")
 	}
-}
 
-func (vm *VirtualMachine) sub(operands shared.Operands, mode shared.AddressMode) {
-	switch mode {
-	case shared.IMMEDIATE:
-		vm.accumulator = vm.accumulator - operands.First
-
-	case shared.DIRECT:
-		vm.accumulator = vm.accumulator - vm.memory[operands.First]
-
-	case shared.INDIRECT:
-		vm.accumulator = vm.accumulator - vm.memory[vm.memoryAddress]
+	cell, err := vm.cell(target)
+	if err != nil {
+		return err
+	}
+	*cell = vm.accumulator
+	return nil
+}
 
-	default:
-		panic("incorrect address mode on SUB operation")
+func (vm *VirtualMachine) sub(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.IMMEDIATE && mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on SUB operation")
 	}
+	value, err := vm.value(operands.First, mode)
+	if err != nil {
+		return err
+	}
+	vm.accumulator = vm.accumulator - value
+	return nil
 }
 
-func (vm *VirtualMachine) write(operands shared.Operands, mode shared.AddressMode) {
-	switch mode {
-	case shared.IMMEDIATE:
-		vm.io.output = operands.First
-	case shared.DIRECT:
-		vm.io.output = vm.memory[operands.First]
-	case shared.INDIRECT:
-		vm.io.output = vm.memory[vm.memoryAddress]
-	default:
-		panic("incorrect address mode on WRITE operation")
+func (vm *VirtualMachine) write(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.IMMEDIATE && mode != shared.DIRECT && mode != shared.INDIRECT {
+		return errors.New("incorrect address mode on WRITE operation")
 	}
+	value, err := vm.value(operands.First, mode)
+	if err != nil {
+		return err
+	}
+	vm.io.output = value
+	return nil
 }
 
-func (vm *VirtualMachine) inj(operands shared.Operands, mode shared.AddressMode) {
-	if mode == shared.IMMEDIATE {
-		vm.memoryAddress = uint16(operands.First)
-	} else {
-		panic("incorrect address mode on INJECT operation")
+func (vm *VirtualMachine) inj(operands shared.Operands, mode shared.AddressMode) error {
+	if mode != shared.IMMEDIATE {
+		return errors.New("incorrect address mode on INJECT operation")
 	}
+	vm.memoryAddress = uint16(operands.First)
+	return nil
 }